@@ -3,17 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 type AOF struct {
-	w    *Writer
-	f    *os.File
-	conf *Config
+	w     *Writer
+	f     *os.File
+	conf  *Config
+	mu    sync.Mutex
+	batch []*Value // Commands of the MULTI/EXEC block currently being written, if any
+	depth int      // How many blocks are open. Blocks can nest, like a script called inside EXEC
 }
 
 // NewAOF creates a new AOF type with the given Config settings
@@ -33,12 +40,149 @@ func NewAOF(conf *Config) *AOF {
 	return &aof
 }
 
-// Sync reads all RESP messages from the AOF file and applies all SET commands found in it
-func (aof *AOF) Sync(maxmem int64, evictionPolicy Eviction, memSamples int) {
+// Append writes a command that changed the DB to the AOF. If a MULTI/EXEC
+// block is open, the command is held back until the block is ended
+func (aof *AOF) Append(v *Value) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.depth > 0 {
+		aof.batch = append(aof.batch, v)
+		return
+	}
+
+	aof.w.Write(v)
+	aof.flushIfNeeded()
+}
+
+// BeginBatch opens a MULTI/EXEC block. Every command appended until
+// EndBatch is called is written to the AOF as part of one transaction.
+// Nested blocks are merged into the outermost one
+func (aof *AOF) BeginBatch() {
+	aof.mu.Lock()
+	aof.depth++
+	aof.mu.Unlock()
+}
+
+// EndBatch closes a MULTI/EXEC block and writes the commands in it, wrapped in MULTI and EXEC,
+// so that replaying the AOF can never apply only part of the block.
+// Nothing is written if no command in the block changed the DB
+func (aof *AOF) EndBatch() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.depth--
+	if aof.depth > 0 || len(aof.batch) == 0 {
+		return
+	}
+
+	aof.w.Write(&Value{typ: ARRAY, array: []Value{{typ: BULK, bulk: "MULTI"}}})
+	for _, v := range aof.batch {
+		aof.w.Write(v)
+	}
+	aof.w.Write(&Value{typ: ARRAY, array: []Value{{typ: BULK, bulk: "EXEC"}}})
+	aof.batch = nil
+
+	aof.flushIfNeeded()
+}
+
+// How many bytes of AOF records are buffered before they're written to the file, when appendfsync is no
+const aofBufferSize = 4096
+
+// flushIfNeeded writes the buffered AOF records to the file right away with appendfsync always,
+// and once enough of them are buffered with no. With everysec, aofCron writes them. Must be called with aof.mu held
+func (aof *AOF) flushIfNeeded() {
+	switch aof.conf.aofFsync {
+	case Always:
+		aof.w.Flush()
+	case No:
+		if aof.w.Queued() >= aofBufferSize {
+			aof.w.Flush()
+		}
+	}
+}
+
+// Flush writes any buffered AOF records to the file
+func (aof *AOF) Flush() {
+	aof.mu.Lock()
+	aof.w.Flush()
+	aof.mu.Unlock()
+}
+
+// Fsync writes any buffered AOF records to the file and forces them to disk, so nothing is lost on shutdown
+func (aof *AOF) Fsync() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.w.Flush()
+	return aof.f.Sync()
+}
+
+// Close writes any buffered AOF records to the file and closes it
+func (aof *AOF) Close() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.w.Flush()
+	aof.f.Close()
+}
+
+// aofCron writes the buffered AOF records to the file every second, when appendfsync is everysec
+func (state *AppState) aofCron() {
+	for range time.Tick(time.Second) {
+		state.conf.mu.RLock()
+		aof, everysec := state.aof, state.conf.aofFsync == EverySec
+		state.conf.mu.RUnlock()
+
+		if aof != nil && everysec {
+			aof.Flush()
+		}
+	}
+}
+
+// applyAppendOnly opens or closes the AOF after CONFIG SET appendonly. Turning it on writes
+// the whole DB to the AOF right away, the same way as BGREWRITEAOF, so it can be replayed from the start.
+// Must be called with the command lock and conf.mu held
+func applyAppendOnly(state *AppState) error {
+	switch {
+	case state.conf.aofEnabled && state.aof == nil:
+		aof := NewAOF(state.conf)
+		if aof.f == nil {
+			return errors.New("can't open the append only file")
+		}
+
+		aof.Rewrite(DB.snapshot(), state.scripts.LibraryCodes())
+		state.aof = aof
+	case !state.conf.aofEnabled && state.aof != nil:
+		if state.aofRewriteRunning {
+			return errors.New("can't turn off the append only file while it's being rewritten")
+		}
+		state.aof.Close()
+		state.aof = nil
+	}
+	return nil
+}
+
+// Sync reads all RESP messages from the AOF file and replays the commands found in it.
+// Commands inside a MULTI/EXEC block are only replayed once the whole block has been read
+func (aof *AOF) Sync(state *AppState) {
+	// Want a blank app state without AOF enabled, but sharing the
+	// script engine so that function libraries get loaded into it
+	blankState := NewAppState(&Config{
+		maxmem:     state.conf.maxmem,
+		eviction:   state.conf.eviction,
+		memSamples: state.conf.memSamples,
+	})
+	blankState.scripts = state.scripts
+	blankClient := Client{}
+
+	var block []*Value
+	inBlock := false
+
 	r := bufio.NewReader(aof.f)
 	for {
 		v := Value{}
-		err := v.readArray(r)
+		err := v.readArray(r, 0) // Everything in the AOF was accepted once, so it's not limited
 		if err == io.EOF {
 			break
 		}
@@ -46,23 +190,57 @@ func (aof *AOF) Sync(maxmem int64, evictionPolicy Eviction, memSamples int) {
 			log.Println("Unexpected error while reading AOF records: ", err)
 			break
 		}
+		if len(v.array) == 0 {
+			continue
+		}
+
+		switch v.array[0].bulk {
+		case "MULTI":
+			inBlock = true
+			block = nil
+		case "EXEC":
+			for _, cmd := range block {
+				replayAOFCommand(&blankClient, cmd, blankState)
+			}
+			inBlock = false
+			block = nil
+		default:
+			if inBlock {
+				block = append(block, &v)
+			} else {
+				replayAOFCommand(&blankClient, &v, blankState)
+			}
+		}
+	}
+
+	if inBlock {
+		log.Println("AOF ends in the middle of a MULTI/EXEC block. Discarding the incomplete block")
+	}
+}
 
-		// Want a blank app state without AOF enabled
-		blankState := NewAppState(&Config{
-			maxmem:     maxmem,
-			eviction:   evictionPolicy,
-			memSamples: memSamples,
-		})
-		blankClient := Client{}
-		set(&blankClient, &v, blankState)
+// replayAOFCommand runs a command read from the AOF file against the DB
+func replayAOFCommand(client *Client, v *Value, state *AppState) {
+	command, ok := lookupCommand(v.array[0].bulk)
+	if !ok {
+		log.Println("Unknown command in AOF: ", repr(v.array[0].bulk))
+		return
+	}
+	if !command.checkArity(v) {
+		log.Println("Wrong number of arguments in AOF: ", v.argsRepr())
+		return
 	}
+	v.array[0].bulk = strings.ToUpper(command.name)
+	command.handler(client, v, state)
 }
 
-// Rewrite rewrites the AOF file to reflect the current state of the DB
-func (aof *AOF) Rewrite(copy map[string]*Item) {
+// Rewrite rewrites the AOF file to reflect the current state of the DB and the loaded function libraries
+func (aof *AOF) Rewrite(copy map[string]*Item, libraries []string) {
 	// Reroute future AOF records to buffer because the file will be busy as we rewrite it
 	var buffer bytes.Buffer
+	aof.mu.Lock()
+	aof.w.Flush()
 	aof.w = NewWriter(&buffer)
+	aof.mu.Unlock()
 
 	// Clear file
 	if err := aof.f.Truncate(0); err != nil {
@@ -79,8 +257,21 @@ func (aof *AOF) Rewrite(copy map[string]*Item) {
 	// Create a new writer for the file
 	fileWriter := NewWriter(aof.f)
 
-	// An AOF file is just an ARRAY of SET strings
+	// Function libraries come first, as a FUNCTION LOAD for each
+	for _, code := range libraries {
+		arr := Value{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "FUNCTION"}, {typ: BULK, bulk: "LOAD"}, {typ: BULK, bulk: "REPLACE"}, {typ: BULK, bulk: code},
+		}}
+		fileWriter.Write(&arr)
+	}
+
+	// The rest of the AOF file is just an ARRAY of SET strings, or RPUSH for lists
 	for k, v := range copy {
+		if v.isList() {
+			fileWriter.Write(bulkArray(append([]string{"RPUSH", k}, v.List...)))
+			continue
+		}
+
 		command := Value{typ: BULK, bulk: "SET"}
 		key := Value{typ: BULK, bulk: k}
 		value := Value{typ: BULK, bulk: v.V}
@@ -93,7 +284,11 @@ func (aof *AOF) Rewrite(copy map[string]*Item) {
 
 	fileWriter.Flush()
 
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
 	// Write the buffer to the file
+	aof.w.Flush()
 	if _, err := buffer.WriteTo(aof.f); err != nil {
 		log.Println("AOF rewrite - Write buffer error: ", err)
 	}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestAOFRandomBinary(t *testing.T) {
+	state := newTestState(t, true)
+	client := &Client{}
+	r := rand.New(rand.NewSource(4))
+	items := randomItems(r, 200)
+
+	// Write every key through the commands that create it, so the AOF gets the same records a client would cause
+	for key, item := range items {
+		var reply *Value
+		if item.isList() {
+			reply = rpush(client, cmdValue(append([]string{"RPUSH", key}, item.List...)...), state)
+		} else {
+			reply = set(client, cmdValue("SET", key, item.V), state)
+		}
+		if reply.typ == ERROR {
+			t.Fatalf("writing %q failed: %s", key, reply.err)
+		}
+	}
+
+	state.aof.Close()
+	DB = NewDatabase()
+	aof := NewAOF(state.conf)
+	defer aof.Close()
+	aof.Sync(state)
+	checkStore(t, items)
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type RDB_Stats struct {
 	rdb_last_save_ts int64
@@ -11,26 +16,38 @@ type AOF_Stats struct {
 	aof_rewrites int
 }
 
+// The counters are atomic, since connections are counted without the command lock
 type GeneralStats struct {
-	total_connections_received int
-	total_commands_processed   int
-	expired_keys               int
-	evicted_keys               int
+	total_connections_received atomic.Int64
+	rejected_connections       atomic.Int64
+
+	client_output_buffer_limit_disconnections atomic.Int64
+	total_commands_processed                  atomic.Int64
+	expired_keys                              atomic.Int64
+	evicted_keys                              atomic.Int64
 }
 
 // Track various context variables useful across the whole app
 type AppState struct {
+	cmdLock           chan struct{} // Held while a command runs, so commands never interleave
 	conf              *Config
-	aof               *AOF
+	listeners         []net.Listener // Closed on shutdown, to stop accepting connections
+	aof               *AOF           // Nil while AOF is off. Only replaced by CONFIG SET appendonly, with conf.mu held
 	bgSaveRunning     bool
 	aofRewriteRunning bool
 	dbCopy            map[string]*Item
-	transaction       *Transaction
+	librariesCopy     []string
 	monitors          []*Client
+	channels          map[string][]*Client // The subscribers of each pub/sub channel
 	serverStart       time.Time
-	clientCount       int
+	clients           map[int64]*Client // Every connected client, by ID
+	clientsMu         sync.Mutex
+	nextClientID      atomic.Int64
+	blockedClients    int
+	pause             *Pause // Set while CLIENT PAUSE holds back commands
 	peakMem           int64
 	info              *Info
+	scripts           *ScriptEngine
 	rdbStats          RDB_Stats
 	aofStats          AOF_Stats
 	generalStats      GeneralStats
@@ -38,32 +55,86 @@ type AppState struct {
 
 // NewAppState creates a new AppState type with the given Config settings
 // If the Config type specifies that AOF should be enabled, it will create a new AOF type
-// and, if necessary, a new goroutine to flush the writer every second
 func NewAppState(conf *Config) *AppState {
 	state := AppState{
-		conf:         conf,
-		serverStart:  time.Now(),
-		info:         NewInfo(),
-		rdbStats:     RDB_Stats{},
-		aofStats:     AOF_Stats{},
-		generalStats: GeneralStats{},
+		conf:        conf,
+		cmdLock:     make(chan struct{}, 1),
+		clients:     map[int64]*Client{},
+		channels:    map[string][]*Client{},
+		serverStart: time.Now(),
+		info:        NewInfo(),
+		scripts:     NewScriptEngine(),
+		rdbStats:    RDB_Stats{},
+		aofStats:    AOF_Stats{},
 	}
 
 	if conf.aofEnabled {
 		state.aof = NewAOF(conf)
+	}
+	return &state
+}
+
+// lock waits until no other command is running, then takes the command lock.
+// It gives up and returns false if the given channel is closed while waiting
+func (state *AppState) lock(cancel <-chan struct{}) bool {
+	// Prefer taking the lock if it's free, even if the channel is closed
+	select {
+	case state.cmdLock <- struct{}{}:
+		return true
+	default:
+	}
 
-		// If aofSync mode is everysec, set up a new goroutine
-		// that, every second, flushes the writers buffer
-		if conf.aofFsync == EverySec {
-			go func() {
-				t := time.NewTicker(time.Second)
-				defer t.Stop()
-
-				for range t.C {
-					state.aof.w.Flush()
-				}
-			}()
+	select {
+	case state.cmdLock <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// unlock releases the command lock, letting the next command run
+func (state *AppState) unlock() {
+	<-state.cmdLock
+}
+
+// addClient registers a newly connected client, unless there are already maxclients clients
+func (state *AppState) addClient(client *Client) bool {
+	state.conf.mu.RLock()
+	maxclients := state.conf.maxclients
+	state.conf.mu.RUnlock()
+
+	state.clientsMu.Lock()
+	defer state.clientsMu.Unlock()
+
+	if len(state.clients) >= maxclients {
+		state.generalStats.rejected_connections.Add(1)
+		return false
+	}
+	state.clients[client.id] = client
+	return true
+}
+
+// resetStats zeroes the counters INFO shows, for CONFIG RESETSTAT. Must be called with the command lock held
+func (state *AppState) resetStats() {
+	state.generalStats.total_connections_received.Store(0)
+	state.generalStats.rejected_connections.Store(0)
+	state.generalStats.client_output_buffer_limit_disconnections.Store(0)
+	state.generalStats.total_commands_processed.Store(0)
+	state.generalStats.expired_keys.Store(0)
+	state.generalStats.evicted_keys.Store(0)
+	state.rdbStats.rdb_saves = 0
+	state.aofStats = AOF_Stats{}
+}
+
+// removeMonitor stops sending MONITOR logs to the given client.
+// Must be called with the command lock held, since MONITOR logs are sent under it
+func (state *AppState) removeMonitor(client *Client) {
+	// Essentially, removes all clients that aren't monitors
+	new := state.monitors[:0]
+	for _, monitor := range state.monitors {
+		if monitor != client {
+			new = append(new, monitor)
 		}
 	}
-	return &state
+	state.monitors = new
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// A BlockedState keeps track of a client that is blocked waiting for one of the given keys to have data,
+// like a BLPOP on empty lists
+type BlockedState struct {
+	keys    []string
+	timeout time.Duration // 0 means wait forever
+	try     func() *Value // Tries to serve the blocked command. Returns nil if there is still nothing to serve
+	expired *Value        // The reply sent when the timeout runs out, or the client is unblocked with CLIENT UNBLOCK
+	reply   chan *Value   // Receives the reply once the client is unblocked
+}
+
+// parseTimeout parses the timeout of blocking commands, given in seconds, possibly with decimals.
+// A timeout of 0 means blocking forever
+func parseTimeout(arg string) (time.Duration, *Value) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, &Value{typ: ERROR, err: "ERR timeout is not a float or out of range"}
+	}
+	if secs < 0 {
+		return 0, &Value{typ: ERROR, err: "ERR timeout is negative"}
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// blockOn tries to serve a blocking command right away. If there's nothing to serve, the client is blocked
+// on the given keys until a push to one of them lets it be served, or the timeout runs out.
+// Returns nil if the client was blocked, in which case the reply is sent once it's unblocked.
+// expired is the reply if the timeout runs out
+func blockOn(client *Client, state *AppState, keys []string, timeout time.Duration, expired *Value, try func() *Value) *Value {
+	if reply := try(); reply != nil {
+		return reply
+	}
+
+	// Blocking commands inside MULTI/EXEC or scripts behave as if they timed out right away,
+	// since those must run without waiting for other clients
+	if client.conn == nil || client.transaction != nil || state.scripts.isRunning() {
+		return expired
+	}
+
+	client.blocked = &BlockedState{
+		keys:    keys,
+		timeout: timeout,
+		try:     try,
+		expired: expired,
+		reply:   make(chan *Value, 1),
+	}
+	for _, key := range keys {
+		DB.blocked[key] = append(DB.blocked[key], client)
+	}
+	state.blockedClients++
+
+	return nil
+}
+
+// unblock removes a blocked client from every key it's waiting on, and sends it the given reply.
+// Must be called with the command lock held
+func (db *Database) unblock(client *Client, reply *Value, state *AppState) {
+	blocked := client.blocked
+	if blocked == nil {
+		return
+	}
+
+	for _, key := range blocked.keys {
+		clients := slices.DeleteFunc(db.blocked[key], func(c *Client) bool {
+			return c == client
+		})
+
+		if len(clients) == 0 {
+			delete(db.blocked, key)
+		} else {
+			db.blocked[key] = clients
+		}
+	}
+
+	client.blocked = nil
+	state.blockedClients--
+	blocked.reply <- reply
+}
+
+// signalKeyAsReady remembers that a key was pushed to, if any client is blocked on it.
+// The blocked clients are served once the current command is done
+func (db *Database) signalKeyAsReady(key string) {
+	if len(db.blocked[key]) == 0 || slices.Contains(db.readyKeys, key) {
+		return
+	}
+	db.readyKeys = append(db.readyKeys, key)
+}
+
+// serveBlockedClients serves the clients blocked on keys that were pushed to, in the order they blocked.
+// Called after every command, so pushes made by MULTI/EXEC or scripts are served once they're done.
+// Must be called with the command lock held
+func serveBlockedClients(state *AppState) {
+	// Serving a client can make more keys ready, like with BLMOVE, so keep going until there are none
+	for len(DB.readyKeys) > 0 {
+		keys := DB.readyKeys
+		DB.readyKeys = nil
+
+		for _, key := range keys {
+			for len(DB.blocked[key]) > 0 {
+				client := DB.blocked[key][0]
+				reply := client.blocked.try()
+				if reply == nil {
+					break // The list is empty again
+				}
+				DB.unblock(client, reply, state)
+			}
+		}
+	}
+}
+
+// waitUntilUnblocked waits for a blocked client to be served, to time out or to be unblocked by CLIENT UNBLOCK.
+// blocked is the client's blocked state, as read while the command that blocked it still held the lock.
+// It returns the reply to send to the client, or false if the client disconnected while blocked
+func (client *Client) waitUntilUnblocked(blocked *BlockedState, state *AppState) (*Value, bool) {
+	var timeout <-chan time.Time
+	if blocked.timeout > 0 {
+		timer := time.NewTimer(blocked.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Keep an eye on the connection, so a client that disconnects doesn't stay blocked
+	// and doesn't get served elements it will never receive
+	disconnected := make(chan struct{})
+	probeDone := make(chan struct{})
+	go func() {
+		defer close(probeDone)
+		_, err := client.reader.Peek(1)
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			close(disconnected)
+		}
+	}()
+	defer func() {
+		// Interrupt the probe, so the connection can be read from again
+		client.conn.SetReadDeadline(time.Now())
+		<-probeDone
+		client.conn.SetReadDeadline(time.Time{})
+	}()
+
+	select {
+	case reply := <-blocked.reply:
+		return reply, true
+	case <-timeout:
+	case <-disconnected:
+	}
+
+	// The client may have been served while waiting for the lock
+	state.lock(nil)
+	defer state.unlock()
+
+	if client.blocked != nil {
+		DB.unblock(client, blocked.expired, state)
+	}
+	reply := <-blocked.reply
+
+	select {
+	case <-disconnected:
+		return nil, false
+	default:
+		return reply, true
+	}
+}
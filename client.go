@@ -1,35 +1,462 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Client struct {
+	id            int64
 	conn          net.Conn
+	reader        *bufio.Reader
+	out           *Writer // Replies are buffered here until the client has no more commands waiting to be read
+	name          string
+	proto         int // The RESP version the client talks, switched with HELLO
 	authenticated bool
+	transaction   *Transaction
+	watchedKeys   []string
+	dirty         bool          // Whether a watched key was modified, which makes EXEC fail
+	blocked       *BlockedState // Set while the client is blocked by a command like BLPOP
+	subscriptions []string      // The pub/sub channels the client is subscribed to
+	tracking      *Tracking     // Set while client-side caching is on
+
+	closeAfterReply bool // Set by QUIT, so the connection is closed once the reply is sent
+
+	// What the client last did, for CLIENT LIST. Only updated with the command lock held, so other clients can read it
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCmd         string // The full name of the last command, like "client|list"
+	queryBufLen     int    // How much pipelined input was waiting when the client last ran a command
+
+	softLimitSince time.Time // When the queued replies went over the soft output buffer limit, zero if they're under it
+	limitReached   bool      // Set once the client is disconnected for going over an output buffer limit
 }
 
-// NewClient creates a new Client type with a given net.Conn and authenticated set to false.
+// NewClient creates a new Client type with a given ID and net.Conn, and authenticated set to false.
 // Keeps track of the state of each client connection
-func NewClient(conn net.Conn) *Client {
-	return &Client{conn: conn}
+func NewClient(id int64, conn net.Conn) *Client {
+	client := &Client{
+		id:              id,
+		conn:            conn,
+		out:             NewWriter(conn),
+		proto:           2,
+		createdAt:       time.Now(),
+		lastInteraction: time.Now(),
+		lastCmd:         "NULL",
+	}
+	client.reader = bufio.NewReader(connReader{client})
+	return client
 }
 
-// writeMonitorLog logs the command sent to the server by a client to the log stream
-func (client *Client) writeMonitorLog(value *Value) {
+// A connReader reads from a client's connection, first sending any buffered replies.
+// The reader only reads from the connection once every command it already has was handled,
+// so pipelined commands get their replies sent together, while a client waiting for its replies always gets them
+type connReader struct {
+	client *Client
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	r.client.out.Flush()
+	return r.client.conn.Read(p)
+}
+
+// writeMonitorLog logs the command sent to the server by a client to the log stream.
+// Must be called with the command lock held
+func (client *Client) writeMonitorLog(value *Value, state *AppState) {
 	log.Println("Relaying command to MONITOR: ", client.conn.LocalAddr().String())
 
-	msg := fmt.Sprintf("%d [%s]", time.Now().Unix(), client.conn.LocalAddr().String())
+	msg := fmt.Sprintf("%d [%s] %s", time.Now().Unix(), client.conn.LocalAddr().String(), value.argsRepr())
+
+	reply := Value{typ: STRING, str: msg}
+	client.push(&reply, state)
+}
 
-	for _, v := range value.array {
-		msg += fmt.Sprintf(" \"%s\"", v.bulk)
+// push sends a message the client didn't ask for, like a pub/sub message or an invalidation.
+// The client may be waiting for its next command, so it's sent in the background right away.
+// If the client doesn't read its messages fast enough, it's disconnected once it goes over its output buffer limits.
+// Must be called with the command lock held
+func (client *Client) push(v *Value, state *AppState) {
+	client.out.Write(v)
+	client.out.RequestFlush()
+	client.checkOutputLimits(state)
+}
+
+// checkOutputLimits disconnects the client if its queued replies go over the hard output buffer limit of its class,
+// or stay over the soft limit for too long. Must be called with the command lock held
+func (client *Client) checkOutputLimits(state *AppState) {
+	if client.limitReached {
+		return
 	}
 
-	writer := NewWriter(client.conn)
-	reply := Value{typ: STRING, str: msg}
-	writer.Write(&reply)
-	writer.Flush()
+	limit := state.conf.outputLimits[client.clientType()]
+	queued := int64(client.out.Queued())
+
+	reached := false
+	switch {
+	case limit.hard > 0 && queued >= limit.hard:
+		reached = true
+	case limit.soft > 0 && queued >= limit.soft:
+		if client.softLimitSince.IsZero() {
+			client.softLimitSince = time.Now()
+		}
+		reached = time.Since(client.softLimitSince) > time.Duration(limit.softSecs)*time.Second
+	default:
+		client.softLimitSince = time.Time{}
+	}
+	if !reached {
+		return
+	}
+
+	// Closing the connection also interrupts any reply being sent, so the client's goroutine can clean up
+	log.Printf("Client %s closed for overcoming of output buffer limits (%d bytes queued)", client.conn.RemoteAddr(), queued)
+	client.limitReached = true
+	state.generalStats.client_output_buffer_limit_disconnections.Add(1)
+	client.conn.Close()
+}
+
+// clientType is the type of client CLIENT LIST and CLIENT KILL filter by.
+// Replication isn't supported, so clients are never masters or replicas
+func (client *Client) clientType() string {
+	if len(client.subscriptions) > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// flags lists the state of the client as letters, the same as in Redis. Must be called with the command lock held
+func (client *Client) flags(state *AppState) string {
+	var flags string
+	if slices.Contains(state.monitors, client) {
+		flags += "O"
+	}
+	if len(client.subscriptions) > 0 {
+		flags += "P"
+	}
+	if client.transaction != nil {
+		flags += "x"
+	}
+	if client.blocked != nil {
+		flags += "b"
+	}
+	if client.tracking != nil {
+		flags += "t"
+	}
+	if client.dirty {
+		flags += "d"
+	}
+	if client.closeAfterReply {
+		flags += "c"
+	}
+	if client.conn.LocalAddr().Network() == "unix" {
+		flags += "U"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// info describes the client as a line of key=value pairs, the way CLIENT LIST and CLIENT INFO do.
+// Must be called with the command lock held
+func (client *Client) info(state *AppState) string {
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d qbuf=%d qbuf-free=%d omem=%d cmd=%s user=default resp=%d\n",
+		client.id,
+		client.conn.RemoteAddr(),
+		client.conn.LocalAddr(),
+		client.name,
+		int(now.Sub(client.createdAt).Seconds()),
+		int(now.Sub(client.lastInteraction).Seconds()),
+		client.flags(state),
+		len(client.subscriptions),
+		client.queryBufLen,
+		client.reader.Size()-client.queryBufLen,
+		client.out.Queued(),
+		client.lastCmd,
+		client.proto,
+	)
+}
+
+// clientsCron checks on every client once a second. It disconnects clients that have been idle for longer
+// than the timeout setting, and clients whose replies stayed over the soft output buffer limit for too long.
+// Blocked clients, subscribers and monitors are never idle, since they're waiting for the server
+func (state *AppState) clientsCron() {
+	for range time.Tick(time.Second) {
+		state.lock(nil)
+		timeout := time.Duration(state.conf.timeout) * time.Second
+		for _, client := range state.sortedClients() {
+			client.checkOutputLimits(state)
+
+			if timeout <= 0 || client.blocked != nil || len(client.subscriptions) > 0 || slices.Contains(state.monitors, client) {
+				continue
+			}
+			if time.Since(client.lastInteraction) > timeout {
+				log.Println("Closing idle client: ", client.conn.RemoteAddr().String())
+				client.conn.Close()
+			}
+		}
+		state.unlock()
+	}
+}
+
+// sortedClients lists the connected clients by ID, which is the order they connected in
+func (state *AppState) sortedClients() []*Client {
+	state.clientsMu.Lock()
+	defer state.clientsMu.Unlock()
+
+	clients := make([]*Client, 0, len(state.clients))
+	for _, client := range state.clients {
+		clients = append(clients, client)
+	}
+	slices.SortFunc(clients, func(a, b *Client) int {
+		return int(a.id - b.id)
+	})
+	return clients
+}
+
+// parseClientType checks a client type given to CLIENT LIST or CLIENT KILL. "slave" is the old name of "replica"
+func parseClientType(arg string) (string, *Value) {
+	typ := strings.ToLower(arg)
+	if typ == "slave" {
+		typ = "replica"
+	}
+	if !contains([]string{"normal", "master", "replica", "pubsub"}, typ) {
+		return "", &Value{typ: ERROR, err: "ERR Unknown client type '" + arg + "'"}
+	}
+	return typ, nil
+}
+
+// clientCmd handles the case of CLIENT Redis messages
+func clientCmd(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "ID":
+		if len(args) != 1 {
+			return wrongArgs("client|id")
+		}
+		return &Value{typ: INTEGER, num: int(client.id)}
+	case "SETNAME":
+		if len(args) != 2 {
+			return wrongArgs("client|setname")
+		}
+		// An empty name removes the name
+		if !validClientName(args[1].bulk) {
+			return &Value{typ: ERROR, err: "ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+		client.name = args[1].bulk
+		return &Value{typ: STRING, str: "OK"}
+	case "GETNAME":
+		if len(args) != 1 {
+			return wrongArgs("client|getname")
+		}
+		if client.name == "" {
+			return &Value{typ: NULL}
+		}
+		return &Value{typ: BULK, bulk: client.name}
+	case "INFO":
+		if len(args) != 1 {
+			return wrongArgs("client|info")
+		}
+		return &Value{typ: VERBATIM, format: "txt", bulk: client.info(state)}
+	case "LIST":
+		return clientList(args[1:], state)
+	case "KILL":
+		if len(args) < 2 {
+			return wrongArgs("client|kill")
+		}
+		return clientKill(client, args[1:], state)
+	case "PAUSE":
+		return clientPause(args[1:], state)
+	case "UNPAUSE":
+		if len(args) != 1 {
+			return wrongArgs("client|unpause")
+		}
+		return clientUnpause(state)
+	case "TRACKING":
+		return clientTracking(client, args[1:], state)
+	case "CACHING":
+		return clientCaching(client, args[1:])
+	case "UNBLOCK":
+		// CLIENT UNBLOCK id [TIMEOUT|ERROR]
+		if len(args) < 2 || len(args) > 3 {
+			return wrongArgs("client|unblock")
+		}
+		id, err := strconv.ParseInt(args[1].bulk, 10, 64)
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+		}
+
+		// By default, the client gets the same reply as if it timed out
+		var reply *Value
+		if len(args) == 3 {
+			switch strings.ToUpper(args[2].bulk) {
+			case "TIMEOUT":
+			case "ERROR":
+				reply = &Value{typ: ERROR, err: "UNBLOCKED client unblocked via CLIENT UNBLOCK"}
+			default:
+				return &Value{typ: ERROR, err: "ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR"}
+			}
+		}
+
+		state.clientsMu.Lock()
+		target, ok := state.clients[id]
+		state.clientsMu.Unlock()
+		if !ok || target.blocked == nil {
+			return &Value{typ: INTEGER, num: 0}
+		}
+		if reply == nil {
+			reply = target.blocked.expired
+		}
+
+		DB.unblock(target, reply, state)
+		return &Value{typ: INTEGER, num: 1}
+	default:
+		return &Value{typ: ERROR, err: "ERR Unknown subcommand '" + args[0].bulk + "' for 'CLIENT' command"}
+	}
+}
+
+// clientList handles CLIENT LIST [TYPE type] [ID id [id...]]
+func clientList(args []Value, state *AppState) *Value {
+	typ := ""
+	var ids []int64
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			var errReply *Value
+			if typ, errReply = parseClientType(args[i+1].bulk); errReply != nil {
+				return errReply
+			}
+			i++
+		case "ID":
+			// Every argument after ID is a client ID
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			for _, arg := range args[i+1:] {
+				id, err := strconv.ParseInt(arg.bulk, 10, 64)
+				if err != nil || id <= 0 {
+					return &Value{typ: ERROR, err: "ERR Invalid client ID"}
+				}
+				ids = append(ids, id)
+			}
+			i = len(args)
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	var list string
+	for _, c := range state.sortedClients() {
+		if typ != "" && c.clientType() != typ {
+			continue
+		}
+		if ids != nil && !slices.Contains(ids, c.id) {
+			continue
+		}
+		list += c.info(state)
+	}
+
+	return &Value{typ: VERBATIM, format: "txt", bulk: list}
+}
+
+// clientKill handles CLIENT KILL addr:port, and CLIENT KILL with filters, like
+// CLIENT KILL [ID id] [ADDR addr:port] [LADDR addr:port] [USER username] [TYPE type] [SKIPME yes|no].
+// Clients matching every filter are disconnected
+func clientKill(client *Client, args []Value, state *AppState) *Value {
+	// The old form kills the client with the given address, even the calling one, and fails if there's none
+	if len(args) == 1 {
+		killed := killClients(client, state, func(c *Client) bool {
+			return c.conn.RemoteAddr().String() == args[0].bulk
+		})
+		if killed == 0 {
+			return &Value{typ: ERROR, err: "ERR No such client"}
+		}
+		return &Value{typ: STRING, str: "OK"}
+	}
+
+	if len(args)%2 != 0 {
+		return &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	var filters []func(*Client) bool
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1].bulk
+
+		switch strings.ToUpper(args[i].bulk) {
+		case "ID":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return &Value{typ: ERROR, err: "ERR client-id should be greater than 0"}
+			}
+			filters = append(filters, func(c *Client) bool { return c.id == id })
+		case "ADDR":
+			filters = append(filters, func(c *Client) bool { return c.conn.RemoteAddr().String() == value })
+		case "LADDR":
+			filters = append(filters, func(c *Client) bool { return c.conn.LocalAddr().String() == value })
+		case "USER":
+			// There are no ACL users, so every client is the default user
+			filters = append(filters, func(c *Client) bool { return value == "default" })
+		case "TYPE":
+			typ, errReply := parseClientType(value)
+			if errReply != nil {
+				return errReply
+			}
+			filters = append(filters, func(c *Client) bool { return c.clientType() == typ })
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	killed := killClients(client, state, func(c *Client) bool {
+		if skipMe && c == client {
+			return false
+		}
+		for _, filter := range filters {
+			if !filter(c) {
+				return false
+			}
+		}
+		return true
+	})
+	return &Value{typ: INTEGER, num: killed}
+}
+
+// killClients disconnects every client that matches, returning how many there were.
+// Closing the connection makes the client's own goroutine stop reading and clean up after it,
+// which also wakes it up if it's blocked. The calling client is only disconnected once its reply is sent
+func killClients(client *Client, state *AppState, match func(*Client) bool) int {
+	killed := 0
+	for _, c := range state.sortedClients() {
+		if !match(c) {
+			continue
+		}
+		if c == client {
+			c.closeAfterReply = true
+		} else {
+			c.conn.Close()
+		}
+		killed++
+	}
+	return killed
 }
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Create a handler function type
+type Handler func(*Client, *Value, *AppState) *Value
+
+// Flags describing how a command behaves, named the same as in Redis
+const (
+	FlagWrite       = "write"       // May modify the DB
+	FlagReadOnly    = "readonly"    // Only reads the DB
+	FlagDenyOOM     = "denyoom"     // May use more memory, so it's refused when out of memory
+	FlagAdmin       = "admin"       // Administrative, like saving or monitoring the server
+	FlagPubSub      = "pubsub"      // Related to pub/sub
+	FlagNoScript    = "noscript"    // Can't be called from scripts
+	FlagLoading     = "loading"     // Allowed while the DB is loading
+	FlagStale       = "stale"       // Allowed while a replica has stale data
+	FlagFast        = "fast"        // Runs in constant or logarithmic time
+	FlagNoAuth      = "no_auth"     // Doesn't need authentication
+	FlagBlocking    = "blocking"    // May block the client
+	FlagMovableKeys = "movablekeys" // Key positions depend on the arguments, like EVAL's numkeys
+)
+
+// A Command describes a command: how to run it, the arguments it takes and how it behaves
+type Command struct {
+	name     string // Lowercase, the way Redis reports command names
+	handler  Handler
+	arity    int // The number of arguments, including the command name. A negative arity means at least that many
+	flags    []string
+	firstKey int // The position of the first key argument, 0 if there are none
+	lastKey  int // The position of the last key argument. Negative positions count from the end
+	step     int // The distance between key arguments
+	// The position of the argument giving the number of keys, for commands like EVAL whose keys follow it.
+	// 0 if the key positions are fixed
+	keyNumIndex int
+	categories  []string
+	summary     string
+	subcommands []*Command // Named like "client|unblock". They're run by the handler of their container
+}
+
+// The command table. Commands are registered in init, since many of the handlers call back into the table
+var Commands = map[string]*Command{}
+
+func init() {
+	for _, cmd := range []*Command{
+		{
+			name: "command", handler: command, arity: -1,
+			flags:       []string{FlagLoading, FlagStale, FlagNoAuth},
+			categories:  []string{"connection"},
+			summary:     "Returns detailed information about all commands.",
+			subcommands: commandSubcommands,
+		},
+		{
+			name: "get", handler: get, arity: 2,
+			flags:    []string{FlagReadOnly, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"string"},
+			summary:    "Returns the string value of a key.",
+		},
+		{
+			name: "set", handler: set, arity: 3,
+			flags:    []string{FlagWrite, FlagDenyOOM},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"string"},
+			summary:    "Sets the string value of a key, ignoring its type.",
+		},
+		{
+			name: "del", handler: del, arity: -2,
+			flags:    []string{FlagWrite},
+			firstKey: 1, lastKey: -1, step: 1,
+			categories: []string{"keyspace"},
+			summary:    "Deletes one or more keys.",
+		},
+		{
+			name: "exists", handler: exists, arity: -2,
+			flags:    []string{FlagReadOnly, FlagFast},
+			firstKey: 1, lastKey: -1, step: 1,
+			categories: []string{"keyspace"},
+			summary:    "Determines whether one or more keys exist.",
+		},
+		{
+			name: "keys", handler: keys, arity: 2,
+			flags:      []string{FlagReadOnly},
+			categories: []string{"keyspace", "dangerous"},
+			summary:    "Returns all key names that match a pattern.",
+		},
+		{
+			name: "save", handler: save, arity: 1,
+			flags:   []string{FlagAdmin, FlagNoScript},
+			summary: "Synchronously saves the database to disk.",
+		},
+		{
+			name: "shutdown", handler: shutdownCmd, arity: -1,
+			flags:   []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale},
+			summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.",
+		},
+		{
+			name: "bgsave", handler: bgsave, arity: 1,
+			flags:   []string{FlagAdmin, FlagNoScript},
+			summary: "Asynchronously saves the database to disk.",
+		},
+		{
+			name: "flushdb", handler: flushdb, arity: 1,
+			flags:      []string{FlagWrite},
+			categories: []string{"keyspace", "dangerous"},
+			summary:    "Removes all keys from the database.",
+		},
+		{
+			name: "dbsize", handler: dbsize, arity: 1,
+			flags:      []string{FlagReadOnly, FlagFast},
+			categories: []string{"keyspace"},
+			summary:    "Returns the number of keys in the database.",
+		},
+		{
+			name: "auth", handler: auth, arity: 2,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast, FlagNoAuth},
+			categories: []string{"connection"},
+			summary:    "Authenticates the connection.",
+		},
+		{
+			name: "expire", handler: expire, arity: 3,
+			flags:    []string{FlagWrite, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"keyspace"},
+			summary:    "Sets the expiration time of a key in seconds.",
+		},
+		{
+			name: "ttl", handler: ttl, arity: 2,
+			flags:    []string{FlagReadOnly, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"keyspace"},
+			summary:    "Returns the expiration time in seconds of a key.",
+		},
+		{
+			name: "bgrewriteaof", handler: bgrewriteaof, arity: 1,
+			flags:   []string{FlagAdmin, FlagNoScript},
+			summary: "Asynchronously rewrites the append-only file to disk.",
+		},
+		{
+			name: "multi", handler: multi, arity: 1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast},
+			categories: []string{"transaction"},
+			summary:    "Starts a transaction.",
+		},
+		{
+			name: "exec", handler: _exec, arity: 1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale},
+			categories: []string{"transaction"},
+			summary:    "Executes all commands in a transaction.",
+		},
+		{
+			name: "discard", handler: discard, arity: 1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast},
+			categories: []string{"transaction"},
+			summary:    "Discards a transaction.",
+		},
+		{
+			name: "watch", handler: watch, arity: -2,
+			flags:    []string{FlagNoScript, FlagLoading, FlagStale, FlagFast},
+			firstKey: 1, lastKey: -1, step: 1,
+			categories: []string{"transaction"},
+			summary:    "Monitors changes to keys to determine the execution of a transaction.",
+		},
+		{
+			name: "unwatch", handler: unwatch, arity: 1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast},
+			categories: []string{"transaction"},
+			summary:    "Forgets about watched keys of a transaction.",
+		},
+		{
+			name: "monitor", handler: monitor, arity: 1,
+			flags:   []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale},
+			summary: "Listens for all requests received by the server in real-time.",
+		},
+		{
+			name: "info", handler: info, arity: -1,
+			flags:      []string{FlagLoading, FlagStale},
+			categories: []string{"dangerous"},
+			summary:    "Returns information and statistics about the server.",
+		},
+		{
+			name: "eval", handler: eval, arity: -3,
+			flags:       []string{FlagNoScript, FlagStale, FlagMovableKeys},
+			keyNumIndex: 2,
+			categories:  []string{"scripting"},
+			summary:     "Executes a server-side Lua script.",
+		},
+		{
+			name: "evalsha", handler: evalsha, arity: -3,
+			flags:       []string{FlagNoScript, FlagStale, FlagMovableKeys},
+			keyNumIndex: 2,
+			categories:  []string{"scripting"},
+			summary:     "Executes a server-side Lua script by SHA1 digest.",
+		},
+		{
+			name: "script", handler: script, arity: -2,
+			flags:       []string{FlagNoScript},
+			categories:  []string{"scripting"},
+			summary:     "A container for Lua scripts management commands.",
+			subcommands: scriptSubcommands,
+		},
+		{
+			name: "function", handler: function, arity: -2,
+			flags:       []string{FlagNoScript},
+			categories:  []string{"scripting"},
+			summary:     "A container for function commands.",
+			subcommands: functionSubcommands,
+		},
+		{
+			name: "fcall", handler: fcall, arity: -3,
+			flags:       []string{FlagNoScript, FlagStale, FlagMovableKeys},
+			keyNumIndex: 2,
+			categories:  []string{"scripting"},
+			summary:     "Invokes a function.",
+		},
+		{
+			name: "fcall_ro", handler: fcallRO, arity: -3,
+			flags:       []string{FlagNoScript, FlagStale, FlagReadOnly, FlagMovableKeys},
+			keyNumIndex: 2,
+			categories:  []string{"scripting"},
+			summary:     "Invokes a read-only function.",
+		},
+		{
+			name: "lpush", handler: lpush, arity: -3,
+			flags:    []string{FlagWrite, FlagDenyOOM, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Prepends one or more elements to a list. Creates the key if it doesn't exist.",
+		},
+		{
+			name: "rpush", handler: rpush, arity: -3,
+			flags:    []string{FlagWrite, FlagDenyOOM, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Appends one or more elements to a list. Creates the key if it doesn't exist.",
+		},
+		{
+			name: "lpop", handler: lpop, arity: -2,
+			flags:    []string{FlagWrite, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.",
+		},
+		{
+			name: "rpop", handler: rpop, arity: -2,
+			flags:    []string{FlagWrite, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Returns and removes the last elements of a list. Deletes the list if the last element was popped.",
+		},
+		{
+			name: "llen", handler: llen, arity: 2,
+			flags:    []string{FlagReadOnly, FlagFast},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Returns the length of a list.",
+		},
+		{
+			name: "lrange", handler: lrange, arity: 4,
+			flags:    []string{FlagReadOnly},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"list"},
+			summary:    "Returns a range of elements from a list.",
+		},
+		{
+			name: "lmove", handler: lmove, arity: 5,
+			flags:    []string{FlagWrite, FlagDenyOOM},
+			firstKey: 1, lastKey: 2, step: 1,
+			categories: []string{"list"},
+			summary:    "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.",
+		},
+		{
+			name: "lmpop", handler: lmpop, arity: -4,
+			flags:       []string{FlagWrite, FlagMovableKeys},
+			keyNumIndex: 1,
+			categories:  []string{"list"},
+			summary:     "Returns multiple elements from a list after removing them. Deletes the list if the last element was popped.",
+		},
+		{
+			name: "blpop", handler: blpop, arity: -3,
+			flags:    []string{FlagWrite, FlagBlocking},
+			firstKey: 1, lastKey: -2, step: 1,
+			categories: []string{"list"},
+			summary:    "Removes and returns the first element in a list. Blocks until an element is available otherwise.",
+		},
+		{
+			name: "brpop", handler: brpop, arity: -3,
+			flags:    []string{FlagWrite, FlagBlocking},
+			firstKey: 1, lastKey: -2, step: 1,
+			categories: []string{"list"},
+			summary:    "Removes and returns the last element in a list. Blocks until an element is available otherwise.",
+		},
+		{
+			name: "blmove", handler: blmove, arity: 6,
+			flags:    []string{FlagWrite, FlagDenyOOM, FlagBlocking},
+			firstKey: 1, lastKey: 2, step: 1,
+			categories: []string{"list"},
+			summary:    "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise.",
+		},
+		{
+			name: "blmpop", handler: blmpop, arity: -5,
+			flags:       []string{FlagWrite, FlagBlocking, FlagMovableKeys},
+			keyNumIndex: 2,
+			categories:  []string{"list"},
+			summary:     "Pops the first element from one of multiple lists. Blocks until an element is available otherwise.",
+		},
+		{
+			name: "config", handler: configCmd, arity: -2,
+			flags:       []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale},
+			summary:     "A container for server configuration commands.",
+			subcommands: configSubcommands,
+		},
+		{
+			name: "subscribe", handler: subscribeCmd, arity: -2,
+			flags:   []string{FlagPubSub, FlagNoScript, FlagLoading, FlagStale},
+			summary: "Listens for messages published to channels.",
+		},
+		{
+			name: "unsubscribe", handler: unsubscribeCmd, arity: -1,
+			flags:   []string{FlagPubSub, FlagNoScript, FlagLoading, FlagStale},
+			summary: "Stops listening to messages posted to channels.",
+		},
+		{
+			name: "publish", handler: publishCmd, arity: 3,
+			flags:   []string{FlagPubSub, FlagLoading, FlagStale, FlagFast},
+			summary: "Posts a message to a channel.",
+		},
+		{
+			name: "client", handler: clientCmd, arity: -2,
+			flags:       []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale},
+			categories:  []string{"connection"},
+			summary:     "A container for client connection commands.",
+			subcommands: clientSubcommands,
+		},
+		{
+			name: "hello", handler: hello, arity: -1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast, FlagNoAuth},
+			categories: []string{"connection"},
+			summary:    "Handshakes with the Redis server.",
+		},
+		{
+			name: "dump", handler: dump, arity: 2,
+			flags:    []string{FlagReadOnly},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"keyspace"},
+			summary:    "Returns a serialized representation of the value stored at a key.",
+		},
+		{
+			name: "restore", handler: restoreCmd, arity: -4,
+			flags:    []string{FlagWrite, FlagDenyOOM},
+			firstKey: 1, lastKey: 1, step: 1,
+			categories: []string{"keyspace", "dangerous"},
+			summary:    "Creates a key from the serialized representation of a value.",
+		},
+		{
+			name: "ping", handler: ping, arity: -1,
+			flags:      []string{FlagFast},
+			categories: []string{"connection"},
+			summary:    "Returns the server's liveliness response.",
+		},
+		{
+			name: "echo", handler: echo, arity: 2,
+			flags:      []string{FlagFast},
+			categories: []string{"connection"},
+			summary:    "Returns the given string.",
+		},
+		{
+			name: "quit", handler: quit, arity: -1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast, FlagNoAuth},
+			categories: []string{"connection"},
+			summary:    "Closes the connection.",
+		},
+		{
+			name: "reset", handler: reset, arity: 1,
+			flags:      []string{FlagNoScript, FlagLoading, FlagStale, FlagFast, FlagNoAuth},
+			categories: []string{"connection"},
+			summary:    "Resets the connection.",
+		},
+	} {
+		Commands[strings.ToUpper(cmd.name)] = cmd
+	}
+}
+
+// Subcommands only describe themselves for COMMAND. Their handling is up to the handler of the container command
+var (
+	commandSubcommands = []*Command{
+		{name: "command|count", arity: 2, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns a count of commands."},
+		{name: "command|info", arity: -2, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns information about one, multiple or all commands."},
+		{name: "command|docs", arity: -2, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns documentary information about one, multiple or all commands."},
+		{name: "command|list", arity: -2, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns a list of command names."},
+		{name: "command|getkeys", arity: -3, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Extracts the key names from an arbitrary command."},
+		{name: "command|getkeysandflags", arity: -3, flags: []string{FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Extracts the key names and access flags for an arbitrary command."},
+	}
+	scriptSubcommands = []*Command{
+		{name: "script|load", arity: 3, flags: []string{FlagNoScript, FlagStale}, categories: []string{"scripting"}, summary: "Loads a server-side Lua script to the script cache."},
+		{name: "script|exists", arity: -3, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Determines whether server-side Lua scripts exist in the script cache."},
+		{name: "script|flush", arity: -2, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Removes all server-side Lua scripts from the script cache."},
+		{name: "script|kill", arity: 2, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Terminates a server-side Lua script during execution."},
+	}
+	functionSubcommands = []*Command{
+		{name: "function|load", arity: -3, flags: []string{FlagWrite, FlagDenyOOM, FlagNoScript}, categories: []string{"scripting"}, summary: "Creates a library."},
+		{name: "function|delete", arity: 3, flags: []string{FlagWrite, FlagNoScript}, categories: []string{"scripting"}, summary: "Deletes a library and its functions."},
+		{name: "function|flush", arity: -2, flags: []string{FlagWrite, FlagNoScript}, categories: []string{"scripting"}, summary: "Deletes all libraries and functions."},
+		{name: "function|list", arity: -2, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Returns information about all libraries."},
+		{name: "function|dump", arity: 2, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Dumps all libraries into a serialized binary payload."},
+		{name: "function|restore", arity: -3, flags: []string{FlagWrite, FlagDenyOOM, FlagNoScript}, categories: []string{"scripting"}, summary: "Restores all libraries from a payload."},
+		{name: "function|kill", arity: 2, flags: []string{FlagNoScript}, categories: []string{"scripting"}, summary: "Terminates a function during execution."},
+	}
+	configSubcommands = []*Command{
+		{name: "config|get", arity: -3, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, summary: "Returns the effective values of configuration parameters."},
+		{name: "config|set", arity: -4, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, summary: "Sets configuration parameters in-flight."},
+		{name: "config|resetstat", arity: 2, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, summary: "Resets the server's statistics."},
+		{name: "config|rewrite", arity: 2, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, summary: "Persists the effective configuration to file."},
+	}
+	clientSubcommands = []*Command{
+		{name: "client|id", arity: 2, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns the unique client ID of the connection."},
+		{name: "client|setname", arity: 3, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Sets the connection name."},
+		{name: "client|getname", arity: 2, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns the name of the connection."},
+		{name: "client|info", arity: 2, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Returns information about the connection."},
+		{name: "client|list", arity: -2, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Lists open connections."},
+		{name: "client|kill", arity: -3, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Terminates open connections."},
+		{name: "client|pause", arity: -3, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Suspends commands processing."},
+		{name: "client|unpause", arity: 2, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Resumes processing commands from paused clients."},
+		{name: "client|tracking", arity: -3, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Controls server-assisted client-side caching for the connection."},
+		{name: "client|caching", arity: 3, flags: []string{FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Instructs the server whether to track the keys in the next request."},
+		{name: "client|unblock", arity: -3, flags: []string{FlagAdmin, FlagNoScript, FlagLoading, FlagStale}, categories: []string{"connection"}, summary: "Unblocks a client blocked by a blocking command from a different connection."},
+	}
+)
+
+// lookupCommand finds a command in the command table. Command names are case-insensitive
+func lookupCommand(name string) (*Command, bool) {
+	cmd, ok := Commands[strings.ToUpper(name)]
+	return cmd, ok
+}
+
+// hasFlag checks whether the command has the given flag
+func (cmd *Command) hasFlag(flag string) bool {
+	return slices.Contains(cmd.flags, flag)
+}
+
+// checkArity checks whether the command was sent with an acceptable number of arguments
+func (cmd *Command) checkArity(v *Value) bool {
+	if cmd.arity < 0 {
+		return len(v.array) >= -cmd.arity
+	}
+	return len(v.array) == cmd.arity
+}
+
+// aclCategories lists the ACL categories of the command. On top of the ones it's given,
+// some come from its flags, the same way as in Redis
+func (cmd *Command) aclCategories() []string {
+	categories := slices.Clone(cmd.categories)
+	add := func(category string) {
+		if !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+
+	if cmd.hasFlag(FlagWrite) {
+		add("write")
+	}
+	if cmd.hasFlag(FlagReadOnly) && !slices.Contains(cmd.categories, "scripting") {
+		add("read")
+	}
+	if cmd.hasFlag(FlagAdmin) {
+		add("admin")
+		add("dangerous")
+	}
+	if cmd.hasFlag(FlagPubSub) {
+		add("pubsub")
+	}
+	if cmd.hasFlag(FlagFast) {
+		add("fast")
+	}
+	if cmd.hasFlag(FlagBlocking) {
+		add("blocking")
+	}
+	if !cmd.hasFlag(FlagFast) {
+		add("slow")
+	}
+
+	return categories
+}
+
+// wrongArgs creates the error sent when a command gets the wrong number of arguments.
+// Subcommands are named like "client|unblock"
+func wrongArgs(name string) *Value {
+	return &Value{typ: ERROR, err: "ERR wrong number of arguments for '" + strings.ToLower(name) + "' command"}
+}
+
+// findCommand finds a command or, given a name like "client|unblock", a subcommand
+func findCommand(name string) (*Command, bool) {
+	container, _, isSubcommand := strings.Cut(name, "|")
+	cmd, ok := lookupCommand(container)
+	if !ok || !isSubcommand {
+		return cmd, ok
+	}
+
+	for _, sub := range cmd.subcommands {
+		if strings.EqualFold(sub.name, name) {
+			return sub, true
+		}
+	}
+	return nil, false
+}
+
+// subcommand finds the subcommand being called, or returns the command itself if it has no such subcommand
+func (cmd *Command) subcommand(v *Value) *Command {
+	if len(cmd.subcommands) > 0 && len(v.array) > 1 {
+		if sub, ok := findCommand(cmd.name + "|" + v.array[1].bulk); ok {
+			return sub
+		}
+	}
+	return cmd
+}
+
+// fullName is the name of the command being called, including the subcommand, like "client|list"
+func (cmd *Command) fullName(v *Value) string {
+	return cmd.subcommand(v).name
+}
+
+// sortedCommands lists the commands in the command table by name, so COMMAND replies don't change order between calls
+func sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(Commands))
+	for _, cmd := range Commands {
+		cmds = append(cmds, cmd)
+	}
+	slices.SortFunc(cmds, func(a, b *Command) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return cmds
+}
+
+// keyPositions finds the positions of the key arguments in a call of the command.
+// Returns false if the arguments don't make sense for it, like a number of keys that's out of range
+func (cmd *Command) keyPositions(args []Value) ([]int, bool) {
+	var positions []int
+
+	if cmd.keyNumIndex > 0 {
+		if cmd.keyNumIndex >= len(args) {
+			return nil, false
+		}
+		numKeys, err := strconv.Atoi(args[cmd.keyNumIndex].bulk)
+		if err != nil || numKeys < 0 || cmd.keyNumIndex+numKeys >= len(args) {
+			return nil, false
+		}
+		for i := 1; i <= numKeys; i++ {
+			positions = append(positions, cmd.keyNumIndex+i)
+		}
+		return positions, true
+	}
+
+	if cmd.firstKey == 0 {
+		return nil, true
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	for i := cmd.firstKey; i <= last; i += cmd.step {
+		positions = append(positions, i)
+	}
+	return positions, true
+}
+
+// keyFlags describes how the command uses its keys, with the key spec flags of Redis
+func (cmd *Command) keyFlags() []string {
+	switch {
+	case cmd.hasFlag(FlagReadOnly):
+		return []string{"RO", "access"}
+	case cmd.hasFlag(FlagWrite) || slices.Contains(cmd.categories, "scripting"):
+		return []string{"RW", "access", "update"}
+	default:
+		return []string{"RO"}
+	}
+}
+
+// keySpecs describes where the keys of the command are, the way COMMAND INFO does in Redis 7
+func (cmd *Command) keySpecs() Value {
+	var beginIndex int
+	var findKeys Value
+
+	switch {
+	case cmd.keyNumIndex > 0:
+		// The keys follow the number of keys
+		beginIndex = cmd.keyNumIndex
+		findKeys = Value{typ: MAP, array: []Value{
+			{typ: BULK, bulk: "type"}, {typ: BULK, bulk: "keynum"},
+			{typ: BULK, bulk: "spec"}, {typ: MAP, array: []Value{
+				{typ: BULK, bulk: "keynumidx"}, {typ: INTEGER, num: 0},
+				{typ: BULK, bulk: "firstkey"}, {typ: INTEGER, num: 1},
+				{typ: BULK, bulk: "keystep"}, {typ: INTEGER, num: 1},
+			}},
+		}}
+	case cmd.firstKey > 0:
+		// A non-negative last key is counted from the first key
+		lastKey := cmd.lastKey
+		if lastKey >= 0 {
+			lastKey -= cmd.firstKey
+		}
+		beginIndex = cmd.firstKey
+		findKeys = Value{typ: MAP, array: []Value{
+			{typ: BULK, bulk: "type"}, {typ: BULK, bulk: "range"},
+			{typ: BULK, bulk: "spec"}, {typ: MAP, array: []Value{
+				{typ: BULK, bulk: "lastkey"}, {typ: INTEGER, num: lastKey},
+				{typ: BULK, bulk: "keystep"}, {typ: INTEGER, num: cmd.step},
+				{typ: BULK, bulk: "limit"}, {typ: INTEGER, num: 0},
+			}},
+		}}
+	default:
+		return Value{typ: ARRAY, array: []Value{}}
+	}
+
+	flags := Value{typ: SET, array: []Value{}}
+	for _, flag := range cmd.keyFlags() {
+		flags.array = append(flags.array, Value{typ: STRING, str: flag})
+	}
+
+	return Value{typ: ARRAY, array: []Value{{typ: MAP, array: []Value{
+		{typ: BULK, bulk: "flags"}, flags,
+		{typ: BULK, bulk: "begin_search"}, {typ: MAP, array: []Value{
+			{typ: BULK, bulk: "type"}, {typ: BULK, bulk: "index"},
+			{typ: BULK, bulk: "spec"}, {typ: MAP, array: []Value{
+				{typ: BULK, bulk: "index"}, {typ: INTEGER, num: beginIndex},
+			}},
+		}},
+		{typ: BULK, bulk: "find_keys"}, findKeys,
+	}}}}
+}
+
+// info describes the command the way COMMAND INFO does: name, arity, flags, key positions,
+// ACL categories, tips, key specs and subcommands
+func (cmd *Command) info() Value {
+	flags := Value{typ: SET, array: []Value{}}
+	for _, flag := range cmd.flags {
+		flags.array = append(flags.array, Value{typ: STRING, str: flag})
+	}
+
+	categories := Value{typ: SET, array: []Value{}}
+	for _, category := range cmd.aclCategories() {
+		categories.array = append(categories.array, Value{typ: STRING, str: "@" + category})
+	}
+
+	subcommands := Value{typ: ARRAY, array: []Value{}}
+	for _, sub := range cmd.subcommands {
+		subcommands.array = append(subcommands.array, sub.info())
+	}
+
+	return Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: cmd.name},
+		{typ: INTEGER, num: cmd.arity},
+		flags,
+		{typ: INTEGER, num: cmd.firstKey},
+		{typ: INTEGER, num: cmd.lastKey},
+		{typ: INTEGER, num: cmd.step},
+		categories,
+		{typ: ARRAY, array: []Value{}}, // No command tips
+		cmd.keySpecs(),
+		subcommands,
+	}}
+}
+
+// group is the group the command is documented under in Redis, going by its categories
+func (cmd *Command) group() string {
+	groups := map[string]string{
+		"string":      "string",
+		"list":        "list",
+		"keyspace":    "generic",
+		"connection":  "connection",
+		"transaction": "transactions",
+		"scripting":   "scripting",
+		"pubsub":      "pubsub",
+	}
+	for _, category := range cmd.aclCategories() {
+		if group, ok := groups[category]; ok {
+			return group
+		}
+	}
+	return "server"
+}
+
+// docs describes the command the way COMMAND DOCS does
+func (cmd *Command) docs() Value {
+	docs := Value{typ: MAP, array: []Value{
+		{typ: BULK, bulk: "summary"}, {typ: BULK, bulk: cmd.summary},
+		{typ: BULK, bulk: "group"}, {typ: BULK, bulk: cmd.group()},
+	}}
+
+	if len(cmd.subcommands) > 0 {
+		subcommands := Value{typ: MAP, array: []Value{}}
+		for _, sub := range cmd.subcommands {
+			subcommands.array = append(subcommands.array, Value{typ: BULK, bulk: sub.name}, sub.docs())
+		}
+		docs.array = append(docs.array, Value{typ: BULK, bulk: "subcommands"}, subcommands)
+	}
+
+	return docs
+}
+
+// command handles the case of COMMAND Redis messages. Clients use it to learn about the commands the server has
+func command(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	// COMMAND on its own describes every command
+	if len(args) == 0 {
+		reply := Value{typ: ARRAY, array: []Value{}}
+		for _, cmd := range sortedCommands() {
+			reply.array = append(reply.array, cmd.info())
+		}
+		return &reply
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "COUNT":
+		if len(args) != 0 {
+			return wrongArgs("command|count")
+		}
+		return &Value{typ: INTEGER, num: len(Commands)}
+	case "INFO":
+		// COMMAND INFO name [name...]. Without names, every command is described. Unknown names get a null
+		reply := Value{typ: ARRAY, array: []Value{}}
+		if len(args) == 0 {
+			for _, cmd := range sortedCommands() {
+				reply.array = append(reply.array, cmd.info())
+			}
+			return &reply
+		}
+		for _, arg := range args {
+			if cmd, ok := findCommand(arg.bulk); ok {
+				reply.array = append(reply.array, cmd.info())
+			} else {
+				reply.array = append(reply.array, Value{typ: NULL})
+			}
+		}
+		return &reply
+	case "DOCS":
+		// COMMAND DOCS [name...]. Unknown names are left out
+		cmds := sortedCommands()
+		if len(args) > 0 {
+			cmds = nil
+			for _, arg := range args {
+				if cmd, ok := findCommand(arg.bulk); ok {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+		reply := Value{typ: MAP, array: []Value{}}
+		for _, cmd := range cmds {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: cmd.name}, cmd.docs())
+		}
+		return &reply
+	case "LIST":
+		return commandList(args)
+	case "GETKEYS", "GETKEYSANDFLAGS":
+		// COMMAND GETKEYS command [arg...]
+		if len(args) == 0 {
+			return wrongArgs("command|" + strings.ToLower(subcommand))
+		}
+		cmd, ok := lookupCommand(args[0].bulk)
+		if !ok {
+			return &Value{typ: ERROR, err: "ERR Invalid command specified"}
+		}
+		if !cmd.checkArity(&Value{typ: ARRAY, array: args}) {
+			return &Value{typ: ERROR, err: "ERR Invalid number of arguments specified for command"}
+		}
+		positions, ok := cmd.keyPositions(args)
+		if !ok {
+			return &Value{typ: ERROR, err: "ERR Invalid arguments specified for command"}
+		}
+		if len(positions) == 0 {
+			return &Value{typ: ERROR, err: "ERR The command has no key arguments"}
+		}
+
+		reply := Value{typ: ARRAY, array: []Value{}}
+		for _, i := range positions {
+			key := Value{typ: BULK, bulk: args[i].bulk}
+			if subcommand == "GETKEYS" {
+				reply.array = append(reply.array, key)
+				continue
+			}
+
+			flags := Value{typ: ARRAY, array: []Value{}}
+			for _, flag := range cmd.keyFlags() {
+				flags.array = append(flags.array, Value{typ: STRING, str: flag})
+			}
+			reply.array = append(reply.array, Value{typ: ARRAY, array: []Value{key, flags}})
+		}
+		return &reply
+	default:
+		return &Value{typ: ERROR, err: "ERR Unknown subcommand '" + v.array[1].bulk + "' for 'COMMAND' command"}
+	}
+}
+
+// commandList handles COMMAND LIST [FILTERBY MODULE name|ACLCAT category|PATTERN pattern]
+func commandList(args []Value) *Value {
+	match := func(cmd *Command) bool { return true }
+
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToUpper(args[0].bulk) != "FILTERBY" {
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+
+		filter := args[2].bulk
+		switch strings.ToUpper(args[1].bulk) {
+		case "MODULE":
+			// There are no modules, so no command comes from one
+			match = func(cmd *Command) bool { return false }
+		case "ACLCAT":
+			match = func(cmd *Command) bool {
+				return slices.Contains(cmd.aclCategories(), strings.ToLower(filter))
+			}
+		case "PATTERN":
+			match = func(cmd *Command) bool {
+				matched, _ := filepath.Match(strings.ToLower(filter), cmd.name)
+				return matched
+			}
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	// Subcommands are listed too, the same as in Redis
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, cmd := range sortedCommands() {
+		for _, c := range append([]*Command{cmd}, cmd.subcommands...) {
+			if match(c) {
+				reply.array = append(reply.array, Value{typ: BULK, bulk: c.name})
+			}
+		}
+	}
+	return &reply
+}
@@ -2,32 +2,452 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // A struct defining the data persistence settings
 type Config struct {
-	config_file string
-	dir         string
-	rdb         []RDBSnapshot
-	rdbFn       string
-	aofEnabled  bool
-	aofFn       string
-	aofFsync    FSyncMode
-	requirepass bool
-	password    string
-	maxmem      int64
-	eviction    Eviction
-	memSamples  int
+	config_file  string
+	overrides    []string // The config lines given on the command line, which win over the file when it's reloaded
+	pidfile      string   // Where to write the process ID while running, if anywhere
+	dir          string
+	rdb          []RDBSnapshot
+	rdbFn        string
+	aofEnabled   bool
+	aofFn        string
+	aofFsync     FSyncMode
+	requirepass  bool
+	password     string
+	maxmem       int64
+	eviction     Eviction
+	memSamples   int
+	luaTimeLimit int // In milliseconds
+
+	shutdownTimeout int // How many seconds SHUTDOWN waits for replicas to catch up. Kept for compatibility, as there are no replicas
+
+	port           int         // The TCP port to listen on. 0 means not listening on TCP
+	bind           []string    // The addresses to listen on. Ones starting with "-" are skipped if they can't be bound
+	unixsocket     string      // The path of a Unix socket to listen on, if any
+	unixsocketperm os.FileMode // The permissions of the Unix socket file. 0 leaves them as the umask has it
+
+	tlsPort         int // The port to listen on for TLS connections, on the same addresses as port. 0 turns TLS off
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsCACertFile   string      // The CA that client certificates must be signed by
+	tlsAuthClients  string      // Whether clients must send a certificate: yes, no or optional
+	tlsProtocols    string      // The TLS versions to accept, like "TLSv1.2 TLSv1.3"
+	tlsCiphersuites string      // The TLS 1.2 cipher suites to accept, separated by colons. Empty means the defaults
+	tlsConfig       *tls.Config // Built from the TLS settings by loadTLS
+
+	protoMaxBulkLen int64 // The longest bulk string a client can send, in bytes
+	maxclients      int
+	timeout         int                    // How many seconds a client can stay idle before it's disconnected. 0 means never
+	tcpKeepalive    int                    // How often to check that clients are still there, in seconds. 0 turns the check off
+	outputLimits    map[string]OutputLimit // By client class: normal, replica or pubsub
+
+	// Guards the settings CONFIG SET can change, for goroutines that read them without holding the command lock
+	mu sync.RWMutex
 }
 
 // NewConfig creates a new Config type with default values
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		rdbFn:           "dump.rdb",
+		aofFn:           "appendonly.aof",
+		aofFsync:        EverySec,
+		eviction:        NoEviction,
+		memSamples:      5,
+		port:            6379,
+		bind:            []string{"*", "-::*"},
+		tlsAuthClients:  "yes",
+		tlsProtocols:    "TLSv1.2 TLSv1.3",
+		luaTimeLimit:    5000,
+		shutdownTimeout: 10,
+		protoMaxBulkLen: 512 * 1024 * 1024,
+		maxclients:      10000,
+		tcpKeepalive:    300,
+		outputLimits: map[string]OutputLimit{
+			"normal":  {},
+			"replica": {hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softSecs: 60},
+			"pubsub":  {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSecs: 60},
+		},
+	}
+}
+
+// An OutputLimit limits how many bytes of replies can wait to be sent to a client, before it's disconnected.
+// A limit of 0 means no limit
+type OutputLimit struct {
+	hard     int64 // The client is disconnected as soon as it goes over the hard limit
+	soft     int64 // The client is disconnected once it stays over the soft limit for softSecs seconds
+	softSecs int
+}
+
+// The client classes output buffer limits are set for, in the order CONFIG GET shows them
+var outputLimitClasses = []string{"normal", "replica", "pubsub"}
+
+// formatOutputLimits formats the output buffer limits the way they're set, like "normal 0 0 0 replica ..."
+func formatOutputLimits(conf *Config) string {
+	var parts []string
+	for _, class := range outputLimitClasses {
+		limit := conf.outputLimits[class]
+		parts = append(parts, fmt.Sprintf("%s %d %d %d", class, limit.hard, limit.soft, limit.softSecs))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseOutputLimits sets the output buffer limits of one or more client classes, given as
+// "class hard soft seconds [class hard soft seconds...]". If any of them is invalid, none are set
+func parseOutputLimits(conf *Config, value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+
+	limits := map[string]OutputLimit{}
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		if !contains(outputLimitClasses, class) {
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+
+		hard, errHard := parseMem(fields[i+1])
+		soft, errSoft := parseMem(fields[i+2])
+		softSecs, errSecs := strconv.Atoi(fields[i+3])
+		if errHard != nil || errSoft != nil || errSecs != nil || hard < 0 || soft < 0 || softSecs < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = OutputLimit{hard: hard, soft: soft, softSecs: softSecs}
+	}
+
+	for class, limit := range limits {
+		conf.outputLimits[class] = limit
+	}
+	return nil
+}
+
+// A ConfigParam is a setting that can be read with CONFIG GET and changed with CONFIG SET,
+// as well as set in the config file
+type ConfigParam struct {
+	name string
+	get  func(conf *Config) string
+	set  func(conf *Config, value string) error
+
+	immutable bool                        // Whether the setting can only be set in the config file or on the command line
+	apply     func(state *AppState) error // Makes a new value take effect after CONFIG SET, like opening the AOF
+	lines     func(conf *Config) []string // The config file lines for the setting, for CONFIG REWRITE. Defaults to one line
+}
+
+// configLines formats the setting the way it's written in config files
+func (param *ConfigParam) configLines(conf *Config) []string {
+	if param.lines != nil {
+		return param.lines(conf)
+	}
+	return []string{param.name + " " + quoteConfigArg(param.get(conf))}
+}
+
+// immutable marks a setting that can't be changed at runtime, like the port to listen on
+func immutable(param *ConfigParam) *ConfigParam {
+	param.immutable = true
+	return param
+}
+
+// withApply gives a setting a function to make new values take effect after CONFIG SET
+func withApply(param *ConfigParam, apply func(state *AppState) error) *ConfigParam {
+	param.apply = apply
+	return param
+}
+
+// intParam creates a ConfigParam for an integer setting between min and max
+func intParam(name string, field func(conf *Config) *int, min, max int) *ConfigParam {
+	return &ConfigParam{
+		name: name,
+		get: func(conf *Config) string {
+			return strconv.Itoa(*field(conf))
+		},
+		set: func(conf *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*field(conf) = n
+			return nil
+		},
+	}
+}
+
+// memParam creates a ConfigParam for a memory setting that can't be lower than min.
+// Values can have units, like 100mb, and are written to config files with the biggest unit that fits
+func memParam(name string, field func(conf *Config) *int64, min int64) *ConfigParam {
+	return &ConfigParam{
+		name: name,
+		get: func(conf *Config) string {
+			return strconv.FormatInt(*field(conf), 10)
+		},
+		set: func(conf *Config, value string) error {
+			n, err := parseMem(value)
+			if err != nil {
+				return errors.New("argument must be a memory value")
+			}
+			if n < min {
+				return fmt.Errorf("argument must be a memory value of at least %d bytes", min)
+			}
+			*field(conf) = n
+			return nil
+		},
+		lines: func(conf *Config) []string {
+			return []string{name + " " + formatMem(*field(conf))}
+		},
+	}
+}
+
+// stringParam creates a ConfigParam for a string setting. validate checks new values, if given
+func stringParam(name string, field func(conf *Config) *string, validate func(value string) error) *ConfigParam {
+	return &ConfigParam{
+		name: name,
+		get: func(conf *Config) string {
+			return *field(conf)
+		},
+		set: func(conf *Config, value string) error {
+			if validate != nil {
+				if err := validate(value); err != nil {
+					return err
+				}
+			}
+			*field(conf) = value
+			return nil
+		},
+	}
+}
+
+// boolParam creates a ConfigParam for a yes/no setting
+func boolParam(name string, field func(conf *Config) *bool) *ConfigParam {
+	return &ConfigParam{
+		name: name,
+		get: func(conf *Config) string {
+			if *field(conf) {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(conf *Config, value string) error {
+			b, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			*field(conf) = b
+			return nil
+		},
+	}
+}
+
+// validateFilename checks that a setting is a file name rather than a path, since the files are always put in dir
+func validateFilename(value string) error {
+	if value == "" || filepath.Base(value) != value {
+		return errors.New("argument can't be a path, just a filename")
+	}
+	return nil
+}
+
+// Every setting, in the order CONFIG GET shows them. Settings are parsed the same way in the config file and by CONFIG SET
+var configParams = []*ConfigParam{
+	withApply(stringParam("dir", func(conf *Config) *string { return &conf.dir }, nil), func(state *AppState) error {
+		return os.MkdirAll(state.conf.dir, 0755)
+	}),
+
+	immutable(intParam("port", func(conf *Config) *int { return &conf.port }, 0, 65535)),
+	immutable(&ConfigParam{
+		name: "bind",
+		get: func(conf *Config) string {
+			return strings.Join(conf.bind, " ")
+		},
+		set: func(conf *Config, value string) error {
+			if len(strings.Fields(value)) == 0 {
+				return errors.New("argument must be one or more addresses")
+			}
+			conf.bind = strings.Fields(value)
+			return nil
+		},
+		lines: func(conf *Config) []string {
+			return []string{"bind " + strings.Join(conf.bind, " ")}
+		},
+	}),
+	immutable(stringParam("unixsocket", func(conf *Config) *string { return &conf.unixsocket }, nil)),
+	immutable(&ConfigParam{
+		name: "unixsocketperm",
+		get: func(conf *Config) string {
+			return strconv.FormatUint(uint64(conf.unixsocketperm), 8)
+		},
+		set: func(conf *Config, value string) error {
+			// Permissions are given in octal, like 700
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || perm > 0777 {
+				return errors.New("Invalid socket file permissions")
+			}
+			conf.unixsocketperm = os.FileMode(perm)
+			return nil
+		},
+	}),
+	immutable(stringParam("pidfile", func(conf *Config) *string { return &conf.pidfile }, nil)),
+
+	immutable(intParam("tls-port", func(conf *Config) *int { return &conf.tlsPort }, 0, 65535)),
+	tlsParam("tls-cert-file", func(conf *Config) *string { return &conf.tlsCertFile }, nil),
+	tlsParam("tls-key-file", func(conf *Config) *string { return &conf.tlsKeyFile }, nil),
+	tlsParam("tls-ca-cert-file", func(conf *Config) *string { return &conf.tlsCACertFile }, nil),
+	tlsParam("tls-auth-clients", func(conf *Config) *string { return &conf.tlsAuthClients }, validateTLSAuthClients),
+	tlsParam("tls-protocols", func(conf *Config) *string { return &conf.tlsProtocols }, validateTLSProtocols),
+	tlsParam("tls-ciphersuites", func(conf *Config) *string { return &conf.tlsCiphersuites }, validateCipherSuites),
+
+	withApply(boolParam("appendonly", func(conf *Config) *bool { return &conf.aofEnabled }), applyAppendOnly),
+	immutable(stringParam("appendfilename", func(conf *Config) *string { return &conf.aofFn }, validateFilename)),
+	{
+		name: "appendfsync",
+		get: func(conf *Config) string {
+			return string(conf.aofFsync)
+		},
+		set: func(conf *Config, value string) error {
+			mode := FSyncMode(strings.ToLower(value))
+			if !slices.Contains(fsyncModes, mode) {
+				return errors.New("argument must be one of: always, everysec, no")
+			}
+			conf.aofFsync = mode
+			return nil
+		},
+	},
+
+	saveParam,
+	stringParam("dbfilename", func(conf *Config) *string { return &conf.rdbFn }, validateFilename),
+	intParam("shutdown-timeout", func(conf *Config) *int { return &conf.shutdownTimeout }, 0, math.MaxInt32),
+
+	{
+		name: "requirepass",
+		get: func(conf *Config) string {
+			return conf.password
+		},
+		set: func(conf *Config, value string) error {
+			// An empty password turns AUTH off
+			conf.requirepass = value != ""
+			conf.password = value
+			return nil
+		},
+	},
+
+	withApply(memParam("maxmemory", func(conf *Config) *int64 { return &conf.maxmem }, 0), func(state *AppState) error {
+		// Free memory right away if the DB is already over the new limit.
+		// With noeviction, or if not enough is freed, writes are refused until it's under the limit
+		DB.mu.Lock()
+		defer DB.mu.Unlock()
+		for state.conf.maxmem > 0 && DB.mem >= state.conf.maxmem {
+			keys := len(DB.store)
+			if err := DB.evictKeys(state, 0); err != nil || len(DB.store) == keys {
+				break
+			}
+		}
+		return nil
+	}),
+	{
+		name: "maxmemory-policy",
+		get: func(conf *Config) string {
+			return string(conf.eviction)
+		},
+		set: func(conf *Config, value string) error {
+			policy := Eviction(strings.ToLower(value))
+			if !slices.Contains(evictionPolicies, policy) {
+				return errors.New("Invalid maxmemory policy")
+			}
+			conf.eviction = policy
+			return nil
+		},
+	},
+	intParam("maxmemory-samples", func(conf *Config) *int { return &conf.memSamples }, 1, 64),
+
+	intParam("lua-time-limit", func(conf *Config) *int { return &conf.luaTimeLimit }, 0, math.MaxInt32),
+
+	memParam("proto-max-bulk-len", func(conf *Config) *int64 { return &conf.protoMaxBulkLen }, 1),
+	withApply(intParam("maxclients", func(conf *Config) *int { return &conf.maxclients }, 1, math.MaxInt32), applyMaxclients),
+	intParam("timeout", func(conf *Config) *int { return &conf.timeout }, 0, math.MaxInt32),
+	intParam("tcp-keepalive", func(conf *Config) *int { return &conf.tcpKeepalive }, 0, math.MaxInt32),
+	{
+		name: "client-output-buffer-limit",
+		get:  formatOutputLimits,
+		set:  parseOutputLimits,
+		lines: func(conf *Config) []string {
+			var lines []string
+			for _, class := range outputLimitClasses {
+				limit := conf.outputLimits[class]
+				lines = append(lines, fmt.Sprintf("client-output-buffer-limit %s %s %s %d", class, formatMem(limit.hard), formatMem(limit.soft), limit.softSecs))
+			}
+			return lines
+		},
+	},
+}
+
+// The RDB snapshot settings. The config file adds a snapshot per save line, while CONFIG SET replaces them all
+var saveParam = withApply(&ConfigParam{
+	name: "save",
+	get: func(conf *Config) string {
+		var parts []string
+		for _, snapshot := range conf.rdb {
+			parts = append(parts, fmt.Sprintf("%d %d", snapshot.Secs, snapshot.KeysChanged))
+		}
+		return strings.Join(parts, " ")
+	},
+	set: func(conf *Config, value string) error {
+		// The value is pairs of seconds and numbers of keys changed, like "900 1 300 10". "" turns RDB snapshots off
+		fields := strings.Fields(value)
+		if len(fields)%2 != 0 {
+			return errors.New("Invalid save parameters")
+		}
+		var snapshots []RDBSnapshot
+		for i := 0; i < len(fields); i += 2 {
+			secs, errSecs := strconv.Atoi(fields[i])
+			keysChanged, errKeys := strconv.Atoi(fields[i+1])
+			if errSecs != nil || errKeys != nil || secs < 1 || keysChanged < 0 {
+				return errors.New("Invalid save parameters")
+			}
+			snapshots = append(snapshots, RDBSnapshot{Secs: secs, KeysChanged: keysChanged})
+		}
+		conf.rdb = snapshots
+		return nil
+	},
+	lines: func(conf *Config) []string {
+		if len(conf.rdb) == 0 {
+			return []string{`save ""`}
+		}
+		var lines []string
+		for _, snapshot := range conf.rdb {
+			lines = append(lines, fmt.Sprintf("save %d %d", snapshot.Secs, snapshot.KeysChanged))
+		}
+		return lines
+	},
+}, func(state *AppState) error {
+	ResetRDBTrackers(state)
+	return nil
+})
+
+// lookupConfigParam finds a setting by name. Setting names are case-insensitive
+func lookupConfigParam(name string) (*ConfigParam, bool) {
+	for _, param := range configParams {
+		if strings.EqualFold(param.name, name) {
+			return param, true
+		}
+	}
+	return nil, false
 }
 
 // For RDB, in how many seconds must how many
@@ -59,142 +479,358 @@ const (
 	VolatileTTL    Eviction = "volatile-ttl"
 )
 
+// The eviction policies maxmemory-policy accepts
+var evictionPolicies = []Eviction{
+	NoEviction, AllKeysRandom, AllKeysLRU, AllKeysLFU, VolatileRandom, VolatileLRU, VolatileLFU, VolatileTTL,
+}
+
+// The fsync modes appendfsync accepts
+var fsyncModes = []FSyncMode{Always, EverySec, No}
+
+// How deep include directives can be nested, so files that include each other are caught
+const maxIncludeDepth = 16
+
+// A ConfigError is an invalid line in a config file or on the command line. The server refuses to start with one
+type ConfigError struct {
+	source string // The config file, or "command line"
+	line   int
+	text   string
+	err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s, line %d: %v\n>>> '%s'", e.source, e.line, e.err, e.text)
+}
+
+// errBadDirective is the error for unknown directives, or directives with the wrong number of arguments
+var errBadDirective = errors.New("Bad directive or wrong number of arguments")
+
 // readConf reads a configuration file and returns a Config type
-// with the settings specified in the file. If the file cannot be
-// read, it returns a Config type with default values
-func readConf(filename string) *Config {
+// with the settings specified in the file, followed by the overrides,
+// which are config lines too, like the ones given on the command line.
+// If the file cannot be opened, the Config has the default values
+// and the overrides, and the error is returned along with it.
+// Invalid lines are returned as a *ConfigError
+func readConf(filename string, overrides []string) (*Config, error) {
 	conf := NewConfig()
 
+	err := readConfFile(filename, conf, 0)
+	if err == nil {
+		conf.config_file = filename
+	}
+	conf.overrides = overrides
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return conf, err
+	}
+
+	// Settings given on the command line win over the ones in the file
+	for i, line := range overrides {
+		if lineErr := parseLine(line, conf, 0); lineErr != nil {
+			return conf, &ConfigError{source: "command line", line: i + 1, text: line, err: lineErr}
+		}
+	}
+
+	// Ensure directory(ies) specified in the config file exist
+	if conf.dir != "" {
+		os.MkdirAll(conf.dir, 0755)
+	}
+
+	return conf, err
+}
+
+// readConfFile parses every line of a configuration file into the Config.
+// depth is how many include directives led to this file
+func readConfFile(filename string, conf *Config, depth int) error {
 	// Try to open the config file
 	f, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Cannot read %s - using default config instead\n", filename)
-		return conf
+		return err
 	}
 	defer f.Close()
 
-	conf.config_file = filename
-
 	s := bufio.NewScanner(f)
 
 	// For each line in the file, parse it
-	for s.Scan() {
+	for n := 1; s.Scan(); n++ {
 		l := s.Text()
-		parseLine(l, conf)
+		if err := parseLine(l, conf, depth); err != nil {
+			// Errors in included files already say where they are
+			var configErr *ConfigError
+			if errors.As(err, &configErr) {
+				return err
+			}
+			return &ConfigError{source: filename, line: n, text: strings.TrimSpace(l), err: err}
+		}
 	}
 
-	if err := s.Err(); err != nil {
-		fmt.Println("Error reading config file: ", err)
-		return conf
+	return s.Err()
+}
+
+// include reads every config file matching the pattern, in alphabetical order, as if their lines were in the including file
+func include(pattern string, conf *Config, depth int) error {
+	if depth >= maxIncludeDepth {
+		return errors.New("Too many nested include directives, files may be including each other")
 	}
 
-	// Ensure directory(ies) specified in the config file exist
-	if conf.dir != "" {
-		os.MkdirAll(conf.dir, 0755)
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	// A pattern without wildcards must match an existing file
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		files = []string{pattern}
 	}
 
-	return conf
+	for _, file := range files {
+		if err := readConfFile(file, conf, depth+1); err != nil {
+			var configErr *ConfigError
+			if errors.As(err, &configErr) {
+				return err
+			}
+			return fmt.Errorf("Can't read included file: %v", err)
+		}
+	}
+	return nil
 }
 
 // parseLine takes a line from a config file and updates the Config
-// accordingly. It splits the line by spaces and uses the first
-// item as the command and the rest as arguments.
-func parseLine(line string, conf *Config) {
-	// Each line in the config file is split by spaces
-	args := strings.Split(line, " ")
+// accordingly. It splits the line into arguments the same way as inline
+// commands, so values can be quoted, and uses the first one as the
+// directive and the rest as its arguments. Empty lines and comments are skipped.
+// depth is how many include directives led to the line
+func parseLine(line string, conf *Config, depth int) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
 
-	// The command is always the first item
-	cmd := args[0]
+	args, err := splitArgs(line)
+	if err != nil {
+		return errors.New("Unbalanced quotes in configuration line")
+	}
+
+	// Directives are case-insensitive
+	cmd := strings.ToLower(args[0])
+	args = args[1:]
 
 	switch cmd {
+	case "include":
+		if len(args) != 1 {
+			return errBadDirective
+		}
+		return include(args[0], conf, depth)
 	case "save":
-		// The number of seconds is always the 2nd item
-		secs, err := strconv.Atoi(args[1])
-		if err != nil {
-			fmt.Println("Invalid number of seconds")
-			return
-		}
-
-		// The number of keys changed is always the 3rd item
-		keysChanged, err := strconv.Atoi(args[2])
-		if err != nil {
-			fmt.Println("Invalid number of keys changed")
-			return
-		}
-
-		// Update the RDB settings based on these values
-		snapshot := RDBSnapshot{
-			Secs:        secs,
-			KeysChanged: keysChanged,
-		}
-		conf.rdb = append(conf.rdb, snapshot)
-	case "dbfilename":
-		conf.rdbFn = args[1]
-	case "appendfilename":
-		conf.aofFn = args[1]
-	case "appendfsync":
-		conf.aofFsync = FSyncMode(args[1])
-	case "dir":
-		conf.dir = args[1]
-	case "appendonly":
-		if args[1] == "yes" {
-			conf.aofEnabled = true
-		} else {
-			conf.aofEnabled = false
-		}
-	case "requirepass":
-		conf.requirepass = true
-		conf.password = args[1]
-	case "maxmemory":
-		maxmem, err := parseMem(args[1])
-		if err != nil {
-			log.Println("Can't parse maxmemory. Defaulting to 0: ", err)
-			conf.maxmem = 0
-			break
+		// save "" turns off RDB snapshots, including the ones set before
+		if len(args) == 1 && args[0] == "" {
+			conf.rdb = nil
+			return nil
 		}
-		conf.maxmem = maxmem
-	case "maxmemory-policy":
-		conf.eviction = Eviction(args[1])
-	case "maxmemory-samples":
-		memSamples, err := strconv.Atoi(args[1])
-		if err != nil {
-			log.Println("Can't parse maxmemory-samples. Defaulting to 50: ", err)
-			conf.memSamples = 50
-			break
+		if len(args) != 2 {
+			return errBadDirective
+		}
+
+		// Unlike CONFIG SET save, each save line adds a snapshot to the ones set before
+		snapshots := conf.rdb
+		if err := saveParam.set(conf, strings.Join(args, " ")); err != nil {
+			return err
 		}
-		conf.memSamples = memSamples
+		conf.rdb = append(snapshots, conf.rdb...)
+	default:
+		// Every other setting is parsed the same way as CONFIG SET does it
+		param, ok := lookupConfigParam(cmd)
+		if !ok || len(args) == 0 {
+			return errBadDirective
+		}
+		return param.set(conf, strings.Join(args, " "))
 	}
+
+	return nil
+}
+
+// parseYesNo parses a boolean setting, given as yes or no
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
 }
 
 // parseMem takes a string representing a memory size and returns an int64 value
 // representing that memory in bytes.
 //
-// It supports "kb", "mb", "gb", and "b" suffixes.
-// For example, "1024kb" would be parsed into 1048576
+// It supports the "k", "m" and "g" suffixes for powers of 1000, the "kb", "mb"
+// and "gb" suffixes for powers of 1024, and "b" for bytes. Suffixes are case-insensitive.
+// For example, "1024kb" would be parsed into 1048576, and "1k" into 1000
 func parseMem(mem string) (int64, error) {
 	mem = strings.TrimSpace(strings.ToLower(mem))
 
 	var multiplier int64 = 1
 
-	switch {
-	case strings.HasSuffix(mem, "kb"):
-		multiplier = 1024
-		mem = strings.TrimSuffix(mem, "kb")
-	case strings.HasSuffix(mem, "mb"):
-		multiplier = 1024 * 1024
-		mem = strings.TrimSuffix(mem, "mb")
-	case strings.HasSuffix(mem, "gb"):
-		multiplier = 1024 * 1024 * 1024
-		mem = strings.TrimSuffix(mem, "gb")
-	case strings.HasSuffix(mem, "b"):
-		multiplier = 1
-		mem = strings.TrimSuffix(mem, "b")
+	// Longer suffixes are checked first, so "kb" isn't taken for "b"
+	suffixes := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1024},
+		{"mb", 1024 * 1024},
+		{"gb", 1024 * 1024 * 1024},
+		{"k", 1000},
+		{"m", 1000 * 1000},
+		{"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	for _, s := range suffixes {
+		if strings.HasSuffix(mem, s.suffix) {
+			multiplier = s.multiplier
+			mem = strings.TrimSuffix(mem, s.suffix)
+			break
+		}
 	}
 
 	num, err := strconv.ParseInt(mem, 10, 64)
 	if err != nil {
 		return 0, err
 	}
+	if num > math.MaxInt64/multiplier || num < math.MinInt64/multiplier {
+		return 0, errors.New("memory value out of range")
+	}
 
 	return num * multiplier, nil
 }
+
+// formatMem formats a memory size in bytes with the biggest of the "gb", "mb" and "kb" units
+// it's a whole number of, the way it's written in config files. For example, 1048576 is formatted as "1mb"
+func formatMem(mem int64) string {
+	switch {
+	case mem == 0:
+		return "0"
+	case mem%(1024*1024*1024) == 0:
+		return fmt.Sprintf("%dgb", mem/(1024*1024*1024))
+	case mem%(1024*1024) == 0:
+		return fmt.Sprintf("%dmb", mem/(1024*1024))
+	case mem%1024 == 0:
+		return fmt.Sprintf("%dkb", mem/1024)
+	}
+	return strconv.FormatInt(mem, 10)
+}
+
+// configCmd handles the case of CONFIG Redis messages
+func configCmd(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		// CONFIG GET pattern [pattern...]
+		if len(args) < 2 {
+			return wrongArgs("config|get")
+		}
+		reply := Value{typ: MAP, array: []Value{}}
+		for _, param := range configParams {
+			for _, pattern := range args[1:] {
+				if matched, _ := filepath.Match(strings.ToLower(pattern.bulk), param.name); matched {
+					reply.array = append(reply.array, Value{typ: BULK, bulk: param.name}, Value{typ: BULK, bulk: param.get(state.conf)})
+					break
+				}
+			}
+		}
+		return &reply
+	case "SET":
+		// CONFIG SET parameter value [parameter value...]
+		if len(args) < 3 || len(args)%2 != 1 {
+			return wrongArgs("config|set")
+		}
+		return configSet(args[1:], state)
+	case "RESETSTAT":
+		// CONFIG RESETSTAT
+		if len(args) != 1 {
+			return wrongArgs("config|resetstat")
+		}
+		state.resetStats()
+		return &Value{typ: STRING, str: "OK"}
+	case "REWRITE":
+		// CONFIG REWRITE
+		if len(args) != 1 {
+			return wrongArgs("config|rewrite")
+		}
+		state.conf.mu.RLock()
+		defer state.conf.mu.RUnlock()
+
+		if err := rewriteConf(state.conf); err != nil {
+			log.Println("CONFIG REWRITE failed: ", err)
+			if state.conf.config_file == "" {
+				return &Value{typ: ERROR, err: "ERR " + err.Error()}
+			}
+			return &Value{typ: ERROR, err: "ERR Rewriting config file: " + err.Error()}
+		}
+		log.Println("CONFIG REWRITE executed with success")
+		return &Value{typ: STRING, str: "OK"}
+	default:
+		return &Value{typ: ERROR, err: "ERR Unknown subcommand '" + args[0].bulk + "' for 'CONFIG' command"}
+	}
+}
+
+// configSet changes settings at runtime. Either every setting is changed, or none are
+func configSet(args []Value, state *AppState) *Value {
+	failed := func(arg string, err string) *Value {
+		return &Value{typ: ERROR, err: "ERR CONFIG SET failed (possibly related to argument '" + arg + "') - " + err}
+	}
+
+	var params []*ConfigParam
+	for i := 0; i < len(args); i += 2 {
+		param, ok := lookupConfigParam(args[i].bulk)
+		if !ok {
+			return &Value{typ: ERROR, err: "ERR Unknown option or number of arguments for CONFIG SET - '" + args[i].bulk + "'"}
+		}
+		if param.immutable {
+			return failed(args[i].bulk, "can't set immutable config")
+		}
+		if slices.Contains(params, param) {
+			return failed(args[i].bulk, "duplicate parameter")
+		}
+		params = append(params, param)
+	}
+
+	state.conf.mu.Lock()
+	defer state.conf.mu.Unlock()
+
+	// Put back the settings that were already changed
+	var old []string
+	rollback := func() {
+		for j := len(old) - 1; j >= 0; j-- {
+			params[j].set(state.conf, old[j])
+		}
+	}
+
+	for i, param := range params {
+		value := param.get(state.conf)
+		if err := param.set(state.conf, args[2*i+1].bulk); err != nil {
+			rollback()
+			return failed(args[2*i].bulk, err.Error())
+		}
+		old = append(old, value)
+	}
+
+	// Settings that need more than a new value to take effect, like opening the AOF, are applied once every setting is set,
+	// since some only make sense together, like a certificate and its key
+	for i, param := range params {
+		if param.apply == nil {
+			continue
+		}
+		if err := param.apply(state); err != nil {
+			log.Printf("CONFIG SET %s failed: %v", param.name, err)
+			rollback()
+			for _, applied := range params[:i] {
+				if applied.apply != nil {
+					applied.apply(state)
+				}
+			}
+			return failed(args[2*i].bulk, err.Error())
+		}
+	}
+
+	return &Value{typ: STRING, str: "OK"}
+}
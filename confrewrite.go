@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rewriteConf updates the config file with the current settings, keeping its comments and the order of its lines.
+// The first line of each setting is replaced by its current value, and any other lines for it are removed.
+// Settings that aren't in the file yet are added at the end, unless they have their default value.
+// Must be called with conf.mu held
+func rewriteConf(conf *Config) error {
+	if conf.config_file == "" {
+		return errors.New("The server is running without a config file")
+	}
+
+	// Rewrite the file a symlink points to, rather than replacing the symlink
+	path, err := filepath.EvalSymlinks(conf.config_file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	if content := strings.TrimRight(string(data), "\n"); content != "" {
+		lines = strings.Split(content, "\n")
+	}
+
+	// Comments, include directives and blank lines stay where they are
+	written := map[string]bool{}
+	var out []string
+	for _, line := range lines {
+		param, ok := lookupConfigParam(configLineDirective(line))
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+		if !written[param.name] {
+			written[param.name] = true
+			out = append(out, param.configLines(conf)...)
+		}
+	}
+
+	defaults := NewConfig()
+	var added []string
+	for _, param := range configParams {
+		if !written[param.name] && param.get(conf) != param.get(defaults) {
+			added = append(added, param.configLines(conf)...)
+		}
+	}
+	if len(added) > 0 {
+		out = append(out, "", "# Generated by CONFIG REWRITE")
+		out = append(out, added...)
+	}
+
+	return replaceFile(path, []byte(strings.Join(out, "\n")+"\n"))
+}
+
+// configLineDirective returns the directive of a config file line, in lower case.
+// Blank lines, comments and lines that can't be parsed have none
+func configLineDirective(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	args, err := splitArgs(line)
+	if err != nil || len(args) == 0 {
+		return ""
+	}
+	return strings.ToLower(args[0])
+}
+
+// replaceFile writes the data to a temporary file next to the given one, then renames it over it,
+// so a crash can never leave a half written file behind. The file keeps its permissions
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Only left to remove if something went wrong
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// quoteConfigArg quotes a config file argument if it's empty or has spaces, quotes or special characters,
+// so it's read back the same way. Quoted arguments use the same escapes as inline commands
+func quoteConfigArg(arg string) string {
+	plain := arg != ""
+	for i := 0; i < len(arg); i++ {
+		if c := arg[i]; c <= ' ' || c > '~' || c == '"' || c == '\'' || c == '\\' {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
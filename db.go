@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -14,6 +15,13 @@ import (
 type Database struct {
 	store         map[string]*Item
 	expiringStore map[string]*Item
+	watchers      map[string][]*Client      // Which clients are WATCHing which keys
+	blocked       map[string][]*Client      // Which clients are blocked waiting on which keys, in the order they blocked
+	readyKeys     []string                  // Keys that got pushed to while clients were blocked on them
+	trackedKeys   map[string]map[int64]bool // Which clients may have cached which keys, by client ID
+	bcastPrefixes map[string]map[int64]bool // Which clients track every key with which prefix, in BCAST mode
+	invalidKeys   []string                  // Tracked keys that changed since invalidations were last sent
+	invalidAll    bool                      // Whether the whole DB changed since invalidations were last sent
 	mu            sync.RWMutex
 	mem           int64
 }
@@ -23,6 +31,10 @@ func NewDatabase() *Database {
 	return &Database{
 		store:         map[string]*Item{},
 		expiringStore: map[string]*Item{},
+		watchers:      map[string][]*Client{},
+		blocked:       map[string][]*Client{},
+		trackedKeys:   map[string]map[int64]bool{},
+		bcastPrefixes: map[string]map[int64]bool{},
 		mu:            sync.RWMutex{},
 	}
 }
@@ -33,6 +45,11 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 		return errors.New("maximum memory reached")
 	}
 
+	// Nothing is evicted while writes are paused. Commands that could use more memory are paused too
+	if state.writesPaused() {
+		return nil
+	}
+
 	// Get a sample of the keys in the DB
 	var samples []sample
 	if strings.Contains(string(state.conf.eviction), "volatile") {
@@ -43,7 +60,7 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 
 	log.Println("Evicting keys from these samples")
 	for _, key := range samples {
-		log.Printf("Key: %s, Value: %v, TTL: %v\n", key.k, key.v.V, time.Until(key.v.Exp).Seconds())
+		log.Printf("Key: %s, Value: %s, TTL: %v\n", repr(key.k), repr(key.v.V), time.Until(key.v.Exp).Seconds())
 	}
 
 	// Local fn to check if enough memory has been freed
@@ -59,7 +76,7 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	evictUntilMemoryFreed := func(samples []sample) int {
 		var n int
 		for _, s := range samples {
-			log.Println("EVICTING: ", s.k)
+			log.Println("EVICTING: ", repr(s.k))
 			db.Delete(s.k)
 			n++
 			if enoughMemoryFreed() {
@@ -73,28 +90,28 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	switch state.conf.eviction {
 	case AllKeysRandom, VolatileRandom:
 		evictedKeys := evictUntilMemoryFreed(samples)
-		state.generalStats.evicted_keys += evictedKeys
+		state.generalStats.evicted_keys.Add(int64(evictedKeys))
 	case AllKeysLRU, VolatileLRU:
 		// Sort by least recently used
 		sort.Slice(samples, func(i, j int) bool {
 			return samples[i].v.LastAccess.After(samples[j].v.LastAccess)
 		})
 		evictedKeys := evictUntilMemoryFreed(samples)
-		state.generalStats.evicted_keys += evictedKeys
+		state.generalStats.evicted_keys.Add(int64(evictedKeys))
 	case AllKeysLFU, VolatileLFU:
 		// Sort by least frequently used
 		sort.Slice(samples, func(i, j int) bool {
 			return samples[i].v.Accesses < samples[j].v.Accesses
 		})
 		evictedKeys := evictUntilMemoryFreed(samples)
-		state.generalStats.evicted_keys += evictedKeys
+		state.generalStats.evicted_keys.Add(int64(evictedKeys))
 	case VolatileTTL:
 		// Sort by closest TTL
 		sort.Slice(samples, func(i, j int) bool {
 			return samples[i].v.Exp.Before(samples[j].v.Exp)
 		})
 		evictedKeys := evictUntilMemoryFreed(samples)
-		state.generalStats.evicted_keys += evictedKeys
+		state.generalStats.evicted_keys.Add(int64(evictedKeys))
 	}
 	return nil
 }
@@ -121,6 +138,7 @@ func (db *Database) Set(k string, v string, state *AppState) error {
 
 	db.store[k] = &Item{V: v}
 	db.mem += keyMem
+	db.touch(k)
 	log.Println("MEMORY: ", db.mem)
 
 	if db.mem > state.peakMem {
@@ -130,6 +148,22 @@ func (db *Database) Set(k string, v string, state *AppState) error {
 	return nil
 }
 
+// snapshot copies every key in the DB, including the elements of lists, which are changed in place.
+// The copy can be saved in the background while commands keep changing the DB.
+// Must be called with the command lock held, since reading keys updates their access stats without db.mu
+func (db *Database) snapshot() map[string]*Item {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	copy := make(map[string]*Item, len(db.store))
+	for key, item := range db.store {
+		clone := *item
+		clone.List = slices.Clone(item.List)
+		copy[key] = &clone
+	}
+	return copy
+}
+
 // Delete is a "public" method to remove a key from the database
 func (db *Database) Delete(k string) {
 	key, ok := db.store[k]
@@ -146,17 +180,20 @@ func (db *Database) Delete(k string) {
 	if ok {
 		delete(db.expiringStore, k)
 	}
+
+	db.touch(k)
 }
 
 // Get is a "public" method to get a key from the database
 func (db *Database) Get(key string, state *AppState) (i *Item, ok bool) {
 	db.mu.RLock()
-	defer db.mu.RUnlock()
-
 	item, ok := db.store[key]
+	db.mu.RUnlock()
 	if !ok {
 		return item, ok
 	}
+
+	// Must not hold the read lock here, since expiring takes the write lock
 	expired := db.tryToExpire(key, item, state)
 	if expired {
 		return &Item{}, false
@@ -166,14 +203,35 @@ func (db *Database) Get(key string, state *AppState) (i *Item, ok bool) {
 	return item, ok
 }
 
+// lookup gets a key from the database, deleting it instead if it has expired.
+// Unlike Get, it must be called with the DB lock held for writing
+func (db *Database) lookup(key string, state *AppState) (*Item, bool) {
+	item, ok := db.store[key]
+	if !ok {
+		return nil, false
+	}
+	if item.shouldExpire() {
+		// While writes are paused, expired keys are only hidden, and deleted once the pause ends
+		if !state.writesPaused() {
+			db.Delete(key)
+			state.generalStats.expired_keys.Add(1)
+		}
+		return nil, false
+	}
+	return item, true
+}
+
 // tryToExpire checks if the given key has expired and should be deleted from the DB
 func (db *Database) tryToExpire(key string, item *Item, state *AppState) bool {
 	// If there is an expiry that has passed, delete the key and return NULL
 	if item.shouldExpire() {
-		DB.mu.Lock()
-		DB.Delete(key)
-		DB.mu.Unlock()
-		state.generalStats.expired_keys++
+		// While writes are paused, expired keys are only hidden, and deleted once the pause ends
+		if !state.writesPaused() {
+			DB.mu.Lock()
+			DB.Delete(key)
+			DB.mu.Unlock()
+			state.generalStats.expired_keys.Add(1)
+		}
 		return true
 	}
 	return false
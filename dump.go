@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of the DUMP payload format. Payloads with a newer version can't be restored
+const dumpVersion = 1
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var ErrBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// A DumpedItem is the part of an Item that DUMP serializes. Expiry and access stats aren't part of the value
+type DumpedItem struct {
+	V    string
+	List []string
+}
+
+// dumpItem serializes the value of an item. The payload is the gob encoded value,
+// followed by a 2 byte version and an 8 byte CRC64 checksum of everything before it, both little endian
+func dumpItem(item *Item) string {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(DumpedItem{V: item.V, List: item.List})
+
+	payload := binary.LittleEndian.AppendUint16(buf.Bytes(), dumpVersion)
+	payload = binary.LittleEndian.AppendUint64(payload, crc64.Checksum(payload, crcTable))
+	return string(payload)
+}
+
+// undumpItem checks the version and checksum of a DUMP payload, and deserializes the item in it
+func undumpItem(payload string) (*Item, error) {
+	data := []byte(payload)
+	if len(data) < 10 {
+		return nil, ErrBadPayload
+	}
+
+	body, footer := data[:len(data)-8], data[len(data)-8:]
+	if crc64.Checksum(body, crcTable) != binary.LittleEndian.Uint64(footer) {
+		return nil, ErrBadPayload
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) > dumpVersion {
+		return nil, ErrBadPayload
+	}
+
+	var dumped DumpedItem
+	if err := gob.NewDecoder(bytes.NewReader(body[:len(body)-2])).Decode(&dumped); err != nil {
+		return nil, errors.New("Bad data format")
+	}
+	return &Item{V: dumped.V, List: dumped.List}, nil
+}
+
+// restore stores an item at the given key, replacing any existing one. Must be called with the DB lock held
+func (db *Database) restore(key string, item *Item, state *AppState) error {
+	// If key already exists, subtract existing memory amount before adding new amount
+	if old, ok := db.store[key]; ok {
+		db.mem -= old.approxMemUsage(key)
+	}
+
+	keyMem := item.approxMemUsage(key)
+
+	// Check if we would be out of memory from this
+	outOfMemory := state.conf.maxmem > 0 && db.mem+keyMem >= state.conf.maxmem
+	if outOfMemory {
+		if err := db.evictKeys(state, keyMem); err != nil {
+			return err
+		}
+	}
+
+	// Evicting may have deleted the old key, so only remove it from the expiring store now
+	delete(db.expiringStore, key)
+	db.store[key] = item
+	if !item.Exp.IsZero() {
+		db.expiringStore[key] = &Item{V: item.V, Exp: item.Exp}
+	}
+
+	db.mem += keyMem
+	if db.mem > state.peakMem {
+		state.peakMem = db.mem
+	}
+
+	db.touch(key)
+	if item.isList() {
+		db.signalKeyAsReady(key)
+	}
+
+	return nil
+}
+
+// dump handles the case of DUMP Redis messages
+func dump(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	item, ok := DB.lookup(args[0].bulk, state)
+	if !ok {
+		return &Value{typ: NULL}
+	}
+
+	return &Value{typ: BULK, bulk: dumpItem(item)}
+}
+
+// restoreCmd handles the case of RESTORE Redis messages
+func restoreCmd(client *Client, v *Value, state *AppState) *Value {
+	// RESTORE key ttl payload [REPLACE] [ABSTTL]
+	args := v.array[1:]
+
+	key := args[0].bulk
+	ttl, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return &Value{typ: ERROR, err: "ERR Invalid TTL value, must be >= 0"}
+	}
+
+	replace, absTTL := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	item, err := undumpItem(args[2].bulk)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
+
+	// A TTL of 0 means the key doesn't expire. Otherwise it's in milliseconds, from now or since the epoch with ABSTTL
+	if ttl > 0 {
+		if absTTL {
+			item.Exp = time.UnixMilli(ttl)
+		} else {
+			item.Exp = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	if _, ok := DB.lookup(key, state); ok && !replace {
+		return &Value{typ: ERROR, err: "BUSYKEY Target key name already exists."}
+	}
+
+	// A key that would already be expired is never created
+	if !item.Exp.IsZero() && item.shouldExpire() {
+		DB.Delete(key)
+	} else if err := DB.restore(key, item, state); err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
+
+	// The expiry is saved as an absolute time, so replaying the AOF later doesn't extend it
+	if state.conf.aofEnabled {
+		expiry := "0"
+		if !item.Exp.IsZero() {
+			expiry = strconv.FormatInt(item.Exp.UnixMilli(), 10)
+		}
+		state.aof.Append(bulkArray([]string{"RESTORE", key, expiry, args[2].bulk, "REPLACE", "ABSTTL"}))
+	}
+
+	if len(state.conf.rdb) >= 0 {
+		IncrementRDBTrackers()
+	}
+
+	return &Value{typ: STRING, str: "OK"}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// randomBytes returns up to maxLen random bytes, which include \0, \r, \n and bytes that aren't valid UTF-8
+func randomBytes(r *rand.Rand, maxLen int) string {
+	b := make([]byte, r.Intn(maxLen+1))
+	r.Read(b)
+	return string(b)
+}
+
+// randomItems creates random string and list keys with binary names, values and elements
+func randomItems(r *rand.Rand, n int) map[string]*Item {
+	items := map[string]*Item{}
+	for len(items) < n {
+		key := randomBytes(r, 32)
+		if r.Intn(2) == 0 {
+			items[key] = &Item{V: randomBytes(r, 256)}
+			continue
+		}
+		list := make([]string, 1+r.Intn(8))
+		for i := range list {
+			list[i] = randomBytes(r, 64)
+		}
+		items[key] = &Item{List: list}
+	}
+	return items
+}
+
+// newTestState creates an AppState with an empty DB, keeping its files in a temporary directory
+func newTestState(t *testing.T, aofEnabled bool) *AppState {
+	t.Helper()
+
+	old := DB
+	DB = NewDatabase()
+	t.Cleanup(func() { DB = old })
+
+	conf := NewConfig()
+	conf.dir = t.TempDir()
+	conf.rdbFn = "dump.rdb"
+	conf.aofFn = "appendonly.aof"
+	conf.aofEnabled = aofEnabled
+	conf.aofFsync = Always
+	state := NewAppState(conf)
+	if state.aof != nil {
+		t.Cleanup(state.aof.Close)
+	}
+	return state
+}
+
+// cmdValue builds a command the way it's read from a client
+func cmdValue(args ...string) *Value {
+	v := Value{typ: ARRAY}
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: BULK, bulk: arg})
+	}
+	return &v
+}
+
+// checkStore checks that the DB holds exactly the given keys and values
+func checkStore(t *testing.T, want map[string]*Item) {
+	t.Helper()
+	if len(DB.store) != len(want) {
+		t.Fatalf("DB has %d keys, want %d", len(DB.store), len(want))
+	}
+	for key, item := range want {
+		got, ok := DB.store[key]
+		if !ok {
+			t.Fatalf("key %q is missing", key)
+		}
+		if got.V != item.V || !slices.Equal(got.List, item.List) {
+			t.Fatalf("key %q is %q %q, want %q %q", key, got.V, got.List, item.V, item.List)
+		}
+	}
+}
+
+func TestDumpItemRandomBinary(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for key, item := range randomItems(r, 200) {
+		got, err := undumpItem(dumpItem(item))
+		if err != nil {
+			t.Fatalf("can't undump %q: %v", key, err)
+		}
+		if got.V != item.V || !slices.Equal(got.List, item.List) {
+			t.Fatalf("%q undumped as %q %q, want %q %q", key, got.V, got.List, item.V, item.List)
+		}
+	}
+}
+
+func TestDumpRestoreRandomBinary(t *testing.T) {
+	state := newTestState(t, false)
+	client := &Client{}
+	r := rand.New(rand.NewSource(2))
+
+	for i := range 100 {
+		key, val := strconv.Itoa(i)+"\x00"+randomBytes(r, 32), randomBytes(r, 256)
+		if reply := set(client, cmdValue("SET", key, val), state); reply.typ != STRING {
+			t.Fatalf("SET %q failed: %s", key, reply.err)
+		}
+		if reply := get(client, cmdValue("GET", key), state); reply.bulk != val {
+			t.Fatalf("GET %q gave %q, want %q", key, reply.bulk, val)
+		}
+
+		payload := dump(client, cmdValue("DUMP", key), state)
+		if payload.typ != BULK {
+			t.Fatalf("DUMP %q gave %v", key, payload.typ)
+		}
+		restored := key + "\x00restored"
+		if reply := restoreCmd(client, cmdValue("RESTORE", restored, "0", payload.bulk), state); reply.typ != STRING {
+			t.Fatalf("RESTORE %q failed: %s", restored, reply.err)
+		}
+		if reply := get(client, cmdValue("GET", restored), state); reply.bulk != val {
+			t.Fatalf("restored %q is %q, want %q", restored, reply.bulk, val)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// How long the top-level code of a library can run while it's being loaded
+const libraryLoadTimeout = 500 * time.Millisecond
+
+// The flags a function can be registered with
+var FunctionFlags = []string{
+	"no-writes",
+	"allow-oom",
+	"allow-stale",
+	"no-cluster",
+	"allow-cross-slot-keys",
+}
+
+// Library and function names can only use these characters
+var functionNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// A Library is a named piece of Lua code that registers one or more functions when loaded.
+// Loaded libraries are saved in both the RDB and AOF files
+type Library struct {
+	name      string
+	code      string
+	functions []*Function
+}
+
+// A Function is a Lua function registered by a library, which can be called with FCALL
+type Function struct {
+	name        string
+	description string
+	flags       []string
+	callback    *lua.LFunction
+	library     *Library
+}
+
+// hasFlag checks whether the function was registered with the given flag
+func (fn *Function) hasFlag(flag string) bool {
+	return slices.Contains(fn.flags, flag)
+}
+
+// parseLibraryMetadata reads the library name from the first line of
+// the library's code, which looks like `#!lua name=mylib`
+func parseLibraryMetadata(code string) (name string, body string, err error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+
+	shebang, body, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(strings.TrimSuffix(shebang[2:], "\r"))
+	if len(fields) == 0 {
+		return "", "", errors.New("Missing library metadata")
+	}
+	if !strings.EqualFold(fields[0], "lua") {
+		return "", "", fmt.Errorf("Engine '%s' not found", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	if !functionNameRegex.MatchString(name) {
+		return "", "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	// Keep an empty first line so that line numbers in errors match the code that was sent
+	return name, "\n" + body, nil
+}
+
+// compileLibrary runs the top-level code of a library in its own environment,
+// and returns the library along with the functions it registered.
+// Nothing is added to the engine yet
+func (engine *ScriptEngine) compileLibrary(code string) (*Library, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "user_function")
+	if err != nil {
+		return nil, errors.New("Error compiling function: " + oneLine(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "user_function")
+	if err != nil {
+		return nil, errors.New("Error compiling function: " + oneLine(err.Error()))
+	}
+
+	L := engine.fL
+	lib := &Library{name: name, code: code}
+
+	// Each library gets its own global environment, which can't be assigned to from Lua.
+	// Anything not defined by the library is looked up in the shared globals, like `redis` at call time
+	env := newScriptEnv(L)
+
+	// While loading, `redis` only lets the library register functions and log
+	loader := L.NewTable()
+	L.SetFuncs(loader, map[string]lua.LGFunction{
+		"register_function": func(L *lua.LState) int {
+			fn, err := parseRegisterFunction(L)
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+				return 0
+			}
+			fn.library = lib
+			for _, other := range lib.functions {
+				if other.name == fn.name {
+					L.RaiseError("Function %s already exists", fn.name)
+					return 0
+				}
+			}
+			lib.functions = append(lib.functions, fn)
+			return 0
+		},
+		"log": func(L *lua.LState) int {
+			L.CheckInt(1)
+			log.Println("Function log:", L.CheckString(2))
+			return 0
+		},
+	})
+	setLogLevels(loader)
+	env.RawSetString("redis", readOnlyTable(L, loader, modifyReadOnly))
+
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = env
+
+	ctx, cancel := context.WithTimeout(context.Background(), libraryLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+
+	// From now on, the library's functions use the `redis` table of whoever calls them
+	env.RawSetString("redis", lua.LNil)
+
+	if ctx.Err() != nil {
+		return nil, errors.New("FUNCTION LOAD timeout")
+	}
+	if err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, errors.New(oneLine(apiErr.Object.String()))
+		}
+		return nil, errors.New(oneLine(err.Error()))
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+
+	return lib, nil
+}
+
+// parseRegisterFunction reads the arguments given to redis.register_function. Either
+// redis.register_function(name, callback) or redis.register_function{function_name=..., callback=..., flags=..., description=...}
+func parseRegisterFunction(L *lua.LState) (*Function, error) {
+	fn := &Function{}
+
+	switch arg := L.Get(1).(type) {
+	case lua.LString:
+		callback, ok := L.Get(2).(*lua.LFunction)
+		if !ok {
+			return nil, errors.New("wrong arguments given to register_function")
+		}
+		fn.name = string(arg)
+		fn.callback = callback
+	case *lua.LTable:
+		var err error
+		arg.ForEach(func(k, v lua.LValue) {
+			switch k.String() {
+			case "function_name":
+				fn.name = v.String()
+			case "description":
+				fn.description = v.String()
+			case "callback":
+				if callback, ok := v.(*lua.LFunction); ok {
+					fn.callback = callback
+				}
+			case "flags":
+				flags, ok := v.(*lua.LTable)
+				if !ok {
+					err = errors.New("flags argument to redis.register_function must be a table representing function flags")
+					return
+				}
+				flags.ForEach(func(_, flag lua.LValue) {
+					if !contains(FunctionFlags, flag.String()) {
+						err = errors.New("unknown flag given")
+						return
+					}
+					fn.flags = append(fn.flags, flag.String())
+				})
+			default:
+				err = errors.New("unknown argument given to register_function")
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if fn.callback == nil {
+			return nil, errors.New("redis.register_function must get a callback argument")
+		}
+	default:
+		return nil, errors.New("wrong arguments given to register_function")
+	}
+
+	if !functionNameRegex.MatchString(fn.name) {
+		return nil, errors.New("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	return fn, nil
+}
+
+// addLibrary compiles and adds a library to the engine. If a library with the same name
+// exists, it's only replaced if replace is set. It returns the name of the library
+func (engine *ScriptEngine) addLibrary(code string, replace bool) (string, error) {
+	lib, err := engine.compileLibrary(code)
+	if err != nil {
+		return "", err
+	}
+
+	old, exists := engine.libraries[lib.name]
+	if exists && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", lib.name)
+	}
+
+	// Function names are unique across all libraries
+	for _, fn := range lib.functions {
+		if other, ok := engine.functions[fn.name]; ok && other.library != old {
+			return "", fmt.Errorf("Function %s already exists", fn.name)
+		}
+	}
+
+	if exists {
+		engine.removeLibrary(lib.name)
+	}
+	engine.libraries[lib.name] = lib
+	for _, fn := range lib.functions {
+		engine.functions[fn.name] = fn
+	}
+	engine.updateLibraryCodes()
+
+	return lib.name, nil
+}
+
+// removeLibrary removes a library and the functions it registered from the engine
+func (engine *ScriptEngine) removeLibrary(name string) bool {
+	lib, ok := engine.libraries[name]
+	if !ok {
+		return false
+	}
+
+	for _, fn := range lib.functions {
+		delete(engine.functions, fn.name)
+	}
+	delete(engine.libraries, name)
+	engine.updateLibraryCodes()
+
+	return true
+}
+
+// flushLibraries removes every library and function, and starts over with a fresh Lua interpreter for them
+func (engine *ScriptEngine) flushLibraries() {
+	engine.libraries = map[string]*Library{}
+	engine.functions = map[string]*Function{}
+	engine.fL.Close()
+	engine.fL = newLuaState()
+	engine.updateLibraryCodes()
+}
+
+// updateLibraryCodes refreshes the list of library codes that gets saved to the RDB and AOF files.
+// It's kept separately so that background saves can read it without holding the command lock
+func (engine *ScriptEngine) updateLibraryCodes() {
+	names := slices.Sorted(maps.Keys(engine.libraries))
+	codes := make([]string, len(names))
+	for i, name := range names {
+		codes[i] = engine.libraries[name].code
+	}
+
+	engine.mu.Lock()
+	engine.libraryCodes = codes
+	engine.mu.Unlock()
+}
+
+// LibraryCodes returns the code of every loaded library, sorted by library name.
+// Loading all of them again restores every function
+func (engine *ScriptEngine) LibraryCodes() []string {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	return slices.Clone(engine.libraryCodes)
+}
+
+// RestoreLibraries loads the given library codes, as saved in the RDB file or by FUNCTION DUMP.
+// The policy decides what happens to the libraries already loaded:
+//   - APPEND keeps them, failing if a library with the same name is restored
+//   - REPLACE keeps them, but replaces any library with the same name
+//   - FLUSH removes all of them first
+//
+// If any library fails to load, the libraries are left as they were
+func (engine *ScriptEngine) RestoreLibraries(codes []string, policy string) error {
+	libraries := maps.Clone(engine.libraries)
+	functions := maps.Clone(engine.functions)
+
+	if policy == "FLUSH" {
+		engine.libraries = map[string]*Library{}
+		engine.functions = map[string]*Function{}
+	}
+
+	for _, code := range codes {
+		if _, err := engine.addLibrary(code, policy == "REPLACE"); err != nil {
+			engine.libraries = libraries
+			engine.functions = functions
+			engine.updateLibraryCodes()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reloadLibraries starts over with a fresh Lua interpreter for functions, and loads every library into it again.
+// Used after a function is killed, since the interpreter may be left in a bad state
+func (engine *ScriptEngine) reloadLibraries() {
+	codes := engine.LibraryCodes()
+	engine.flushLibraries()
+	if err := engine.RestoreLibraries(codes, "APPEND"); err != nil {
+		log.Println("Error reloading function libraries: ", err)
+	}
+}
+
+// dumpLibraries serializes every loaded library, to be loaded again with FUNCTION RESTORE
+func dumpLibraries(codes []string) (string, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(codes); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// fcallFunction runs the function with the given name, passing it the keys and args as two Lua tables.
+// If readOnly is set, the function must have been registered with the no-writes flag
+func (engine *ScriptEngine) fcallFunction(name string, keys, args []Value, client *Client, state *AppState, readOnly bool) *Value {
+	fn, ok := engine.functions[name]
+	if !ok {
+		return &Value{typ: ERROR, err: "ERR Function not found"}
+	}
+
+	noWrites := fn.hasFlag("no-writes")
+	if readOnly && !noWrites {
+		return &Value{typ: ERROR, err: "ERR Can not execute a script with write flag using *_ro command."}
+	}
+
+	L := engine.fL
+	fnArgs := []lua.LValue{valuesToLuaTable(L, keys), valuesToLuaTable(L, args)}
+
+	ret, killed, err := engine.execute(L, fn.callback, fnArgs, client, state, noWrites)
+	if killed {
+		engine.reloadLibraries()
+		return &Value{typ: ERROR, err: "ERR Script killed by user with FUNCTION KILL..."}
+	}
+	if err != nil {
+		return scriptError(name, err)
+	}
+
+	return luaToValue(L, ret)
+}
+
+// fcall handles the case of FCALL Redis messages
+func fcall(client *Client, v *Value, state *AppState) *Value {
+	return fcallCommand(client, v, state, false)
+}
+
+// fcallRO handles the case of FCALL_RO Redis messages
+func fcallRO(client *Client, v *Value, state *AppState) *Value {
+	return fcallCommand(client, v, state, true)
+}
+
+// fcallCommand runs a function for both FCALL and FCALL_RO
+func fcallCommand(client *Client, v *Value, state *AppState, readOnly bool) *Value {
+	args := v.array[1:]
+
+	keys, argv, errReply := parseScriptArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+
+	return state.scripts.fcallFunction(args[0].bulk, keys, argv, client, state, readOnly)
+}
+
+// function handles the case of FUNCTION Redis messages
+func function(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	engine := state.scripts
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	var reply *Value
+	switch subcommand {
+	case "LOAD":
+		replace := len(args) == 2 && strings.ToUpper(args[0].bulk) == "REPLACE"
+		if len(args) != 1 && !replace {
+			return wrongArgs("function|load")
+		}
+		name, err := engine.addLibrary(args[len(args)-1].bulk, replace)
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR " + err.Error()}
+		}
+		reply = &Value{typ: BULK, bulk: name}
+	case "DELETE":
+		if len(args) != 1 {
+			return wrongArgs("function|delete")
+		}
+		if !engine.removeLibrary(args[0].bulk) {
+			return &Value{typ: ERROR, err: "ERR Library not found"}
+		}
+		reply = &Value{typ: STRING, str: "OK"}
+	case "FLUSH":
+		// ASYNC and SYNC are accepted for compatibility, but flushing is always synchronous
+		if len(args) > 1 || (len(args) == 1 && !contains([]string{"ASYNC", "SYNC"}, strings.ToUpper(args[0].bulk))) {
+			return &Value{typ: ERROR, err: "ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}
+		}
+		engine.flushLibraries()
+		reply = &Value{typ: STRING, str: "OK"}
+	case "LIST":
+		return functionList(args, engine)
+	case "DUMP":
+		payload, err := dumpLibraries(engine.LibraryCodes())
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR " + err.Error()}
+		}
+		return &Value{typ: BULK, bulk: payload}
+	case "RESTORE":
+		if len(args) < 1 || len(args) > 2 {
+			return wrongArgs("function|restore")
+		}
+		policy := "APPEND"
+		if len(args) == 2 {
+			policy = strings.ToUpper(args[1].bulk)
+			if !contains([]string{"APPEND", "REPLACE", "FLUSH"}, policy) {
+				return &Value{typ: ERROR, err: "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}
+			}
+		}
+
+		var codes []string
+		if err := gob.NewDecoder(strings.NewReader(args[0].bulk)).Decode(&codes); err != nil {
+			return &Value{typ: ERROR, err: "ERR payload version or checksum are wrong"}
+		}
+		if err := engine.RestoreLibraries(codes, policy); err != nil {
+			return &Value{typ: ERROR, err: "ERR " + err.Error()}
+		}
+		reply = &Value{typ: STRING, str: "OK"}
+	case "KILL":
+		return engine.kill()
+	default:
+		return &Value{typ: ERROR, err: "ERR Unknown subcommand '" + v.array[1].bulk + "' for 'FUNCTION' command"}
+	}
+
+	// Changes to the loaded libraries are saved to the AOF, so they're restored on restart
+	if state.conf.aofEnabled {
+		state.aof.Append(v)
+	}
+
+	return reply
+}
+
+// functionList handles FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func functionList(args []Value, engine *ScriptEngine) *Value {
+	pattern := "*"
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR library name argument was not given"}
+			}
+			i++
+			pattern = args[i].bulk
+		default:
+			return &Value{typ: ERROR, err: "ERR Unknown argument " + args[i].bulk}
+		}
+	}
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, name := range slices.Sorted(maps.Keys(engine.libraries)) {
+		lib := engine.libraries[name]
+		if matched, _ := filepath.Match(pattern, name); !matched {
+			continue
+		}
+
+		functions := Value{typ: ARRAY, array: []Value{}}
+		for _, fn := range lib.functions {
+			description := Value{typ: NULL}
+			if fn.description != "" {
+				description = Value{typ: BULK, bulk: fn.description}
+			}
+			flags := Value{typ: SET, array: []Value{}}
+			for _, flag := range fn.flags {
+				flags.array = append(flags.array, Value{typ: BULK, bulk: flag})
+			}
+
+			functions.array = append(functions.array, Value{typ: MAP, array: []Value{
+				{typ: BULK, bulk: "name"}, {typ: BULK, bulk: fn.name},
+				{typ: BULK, bulk: "description"}, description,
+				{typ: BULK, bulk: "flags"}, flags,
+			}})
+		}
+
+		entry := Value{typ: MAP, array: []Value{
+			{typ: BULK, bulk: "library_name"}, {typ: BULK, bulk: lib.name},
+			{typ: BULK, bulk: "engine"}, {typ: BULK, bulk: "LUA"},
+			{typ: BULK, bulk: "functions"}, functions,
+		}}
+		if withCode {
+			entry.array = append(entry.array, Value{typ: BULK, bulk: "library_code"}, Value{typ: BULK, bulk: lib.code})
+		}
+		reply.array = append(reply.array, entry)
+	}
+
+	return &reply
+}
@@ -4,7 +4,10 @@ go 1.23.0
 
 toolchain go1.24.9
 
-require github.com/shirou/gopsutil/v4 v4.25.8
+require (
+	github.com/shirou/gopsutil/v4 v4.25.8
+	github.com/yuin/gopher-lua v1.1.2
+)
 
 require (
 	github.com/ebitengine/purego v0.8.4 // indirect
@@ -2,111 +2,162 @@ package main
 
 import (
 	"log"
-	"maps"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Create a handler function type
-type Handler func(*Client, *Value, *AppState) *Value
-
-var Handlers = map[string]Handler{
-	"COMMAND":      command,
-	"GET":          get,
-	"SET":          set,
-	"DEL":          del,
-	"EXISTS":       exists,
-	"KEYS":         keys,
-	"SAVE":         save,
-	"BGSAVE":       bgsave,
-	"FLUSHDB":      flushdb,
-	"DBSIZE":       dbsize,
-	"AUTH":         auth,
-	"EXPIRE":       expire,
-	"TTL":          ttl,
-	"BGREWRITEAOF": bgrewriteaof,
-	"MULTI":        multi,
-	"EXEC":         _exec, // exec is a Go builtin
-	"DISCARD":      discard,
-	"MONITOR":      monitor,
-	"INFO":         info,
-}
-
-// These commands don't need auth
-var SafeCommands = []string{
-	"COMMAND",
-	"AUTH",
-}
-
 // handle takes a Client and a Value type and calls the handler
 // associated with the bulk string of the first message in the Value.
-// It then writes the reply from the handler back to the connection.
+// It then writes the reply from the handler to the client's output buffer, which gets flushed before reading more commands.
 func handle(client *Client, v *Value, state *AppState) {
-	// Get the bulk string of the first message
-	cmd := v.array[0].bulk
-
-	w := NewWriter(client.conn)
+	w := client.out
 
-	// Get the handler
-	handler, ok := Handlers[cmd]
+	// Look up the command. Names are case-insensitive, so handlers always see them in uppercase
+	command, ok := lookupCommand(v.array[0].bulk)
 	if !ok {
-		w.Write(&Value{typ: ERROR, err: "ERR Invalid command"})
-		w.Flush()
+		client.flagTransaction()
+		w.Write(unknownCommand(v))
 		return
 	}
+	cmd := strings.ToUpper(command.name)
+	v.array[0].bulk = cmd
 
-	// If auth is needed and we're not logged-in and the command isn't safe, NOAUTH error
-	if state.conf.requirepass && !client.authenticated && !contains(SafeCommands, cmd) {
+	// If auth is needed and we're not logged-in and the command doesn't skip auth, NOAUTH error
+	if state.conf.requirepass && !client.authenticated && !command.hasFlag(FlagNoAuth) {
 		w.Write(&Value{typ: ERROR, err: "NOAUTH Authentication required"})
-		w.Flush()
+		return
+	}
+
+	// RESP2 clients subscribed to channels can only run pub/sub commands, since their replies could be mistaken for messages
+	if client.proto == 2 && len(client.subscriptions) > 0 && !contains(subscribedModeCommands, cmd) {
+		client.flagTransaction()
+		w.Write(&Value{typ: ERROR, err: "ERR Can't execute '" + command.fullName(v) + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"})
 		return
 	}
 
 	// If there's a transaction happening and the command isn't one of the commands that can end it...
-	if state.transaction != nil && cmd != "EXEC" && cmd != "DISCARD" {
-		// Can't start MULTI if already in MULTI
-		if cmd == "MULTI" {
-			w.Write(&Value{typ: ERROR, err: "ERR MULTI calls can't be nested"})
-			w.Flush()
+	if client.transaction != nil && cmd != "EXEC" && cmd != "DISCARD" && cmd != "QUIT" && cmd != "RESET" {
+		// Any command that is rejected while queueing makes the whole transaction fail on EXEC
+		var queueErr *Value
+		switch {
+		case cmd == "MULTI": // Can't start MULTI if already in MULTI
+			queueErr = &Value{typ: ERROR, err: "ERR MULTI calls can't be nested"}
+		case cmd == "WATCH": // Keys must be watched before the transaction starts
+			queueErr = &Value{typ: ERROR, err: "ERR WATCH inside MULTI is not allowed"}
+		case !command.checkArity(v):
+			queueErr = wrongArgs(command.name)
+		}
+		if queueErr != nil {
+			client.flagTransaction()
+			w.Write(queueErr)
 			return
 		}
 		// Queue the given command
-		transactionCommand := TxCommand{v: v, handler: handler}
-		state.transaction.commands = append(state.transaction.commands, &transactionCommand)
+		transactionCommand := TxCommand{v: v, command: command}
+		client.transaction.commands = append(client.transaction.commands, &transactionCommand)
 		w.Write(&Value{typ: STRING, str: "QUEUED"})
+		return
+	}
+
+	if !command.checkArity(v) {
+		w.Write(wrongArgs(command.name))
+		return
+	}
+
+	// Only one command runs at a time, so no client can ever see another's command half-done.
+	// This is what makes EXEC and scripts atomic, since they hold the lock for as long as they run.
+	// If a script runs for too long, every command but SCRIPT KILL, FUNCTION KILL and SHUTDOWN NOSAVE is refused until it ends.
+	// They can't wait for the lock, since the script holds it
+	for {
+		if !state.lock(state.scripts.busyChan()) {
+			if (cmd == "SCRIPT" || cmd == "FUNCTION") && len(v.array) == 2 && strings.ToUpper(v.array[1].bulk) == "KILL" {
+				w.Write(state.scripts.kill())
+			} else if opts, err := parseShutdownOptions(v.array[1:]); cmd == "SHUTDOWN" && err == nil && opts.nosave && !opts.abort {
+				// Nothing is saved, so the script can be left running until the process exits
+				w.Write(shutdownReply(state.shutdown(opts)))
+			} else {
+				w.Write(&Value{typ: ERROR, err: "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."})
+			}
+			return
+		}
+
+		// While clients are paused, the commands held back by the pause wait for it to end instead of being refused.
+		// Any pipelined replies are sent first
+		pause := state.pausedFor(client, command, v)
+		if pause == nil {
+			break
+		}
+		state.unlock()
 		w.Flush()
+		pause.wait()
+	}
+
+	// Remember what the client last did, for CLIENT LIST
+	client.lastInteraction = time.Now()
+	client.lastCmd = command.fullName(v)
+	client.queryBufLen = client.reader.Buffered()
+
+	// Commands that may use more memory are refused if no memory can be freed.
+	// For EXEC, that's the case if any of the queued commands may use more memory
+	denyOOM := command.hasFlag(FlagDenyOOM) || (cmd == "EXEC" && client.transaction != nil && client.transaction.hasFlag(FlagDenyOOM))
+	if denyOOM && outOfMemory(state) {
+		oom := "OOM command not allowed when used memory > 'maxmemory'."
+		if cmd == "EXEC" {
+			// The transaction can't run, so it's discarded
+			client.transaction = nil
+			DB.mu.Lock()
+			DB.unwatch(client)
+			DB.mu.Unlock()
+			oom = "EXECABORT Transaction discarded because of: " + oom
+		}
+		state.unlock()
+		w.Write(&Value{typ: ERROR, err: oom})
 		return
 	}
 
-	reply := handler(client, v, state)
-	w.Write(reply)
-	w.Flush() // For network connections, always flush after writing
+	reply := command.handler(client, v, state)
+	// Read while the lock is held, since a push from another client can unblock the client as soon as it's released
+	blocked := client.blocked
+	if reply == nil && blocked == nil {
+		reply = &Value{typ: NULL} // Only blocking commands may reply with nil
+	}
+	DB.rememberKeys(client, command, v)
+	serveBlockedClients(state)
+	sendInvalidations(state, client)
 
-	state.generalStats.total_commands_processed++
+	// CLIENT CACHING only applies to the command after it
+	if client.tracking != nil && command.fullName(v) != "client|caching" {
+		client.tracking.caching = false
+	}
 
 	// Write the command to the monitor log (as long as the monitor isn't the client itself)
-	go func() {
-		for _, monitor := range state.monitors {
-			if monitor != client {
-				monitor.writeMonitorLog(v)
-			}
+	for _, monitor := range state.monitors {
+		if monitor != client {
+			monitor.writeMonitorLog(v, state)
 		}
-	}()
-}
+	}
+	state.generalStats.total_commands_processed.Add(1)
+	state.unlock()
 
-// command is a stub function that just returns a basic OK string message
-func command(client *Client, v *Value, state *AppState) *Value {
-	return &Value{typ: STRING, str: "OK"}
+	// A nil reply means the command blocked the client, so send any pipelined replies and wait for the actual reply
+	if reply == nil {
+		w.Flush()
+		var ok bool
+		reply, ok = client.waitUntilUnblocked(blocked, state)
+		if !ok {
+			return
+		}
+	}
+
+	w.Write(reply)
 }
 
 // get handles the case of GET Redis messages
 func get(client *Client, v *Value, state *AppState) *Value {
 	// GET can only take 1 argument
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for the 'GET' command"}
-	}
 
 	// Get the bulk string from the DB, making sure to lock and unlock the
 	// critical section
@@ -116,6 +167,10 @@ func get(client *Client, v *Value, state *AppState) *Value {
 		return &Value{typ: NULL}
 	}
 
+	if item.isList() {
+		return errorReply(ErrWrongType)
+	}
+
 	// Create and return a new bulk string object based on the value
 	return &Value{typ: BULK, bulk: item.V}
 }
@@ -124,9 +179,6 @@ func get(client *Client, v *Value, state *AppState) *Value {
 func set(client *Client, v *Value, state *AppState) *Value {
 	// SET must take 2 arguments
 	args := v.array[1:]
-	if len(args) != 2 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for the 'SET' command"}
-	}
 
 	// Get the key and value and set the DB with those in mind
 	key := args[0].bulk
@@ -141,11 +193,7 @@ func set(client *Client, v *Value, state *AppState) *Value {
 	// If AOF is enabled, write to its buffer
 	if state.conf.aofEnabled {
 		log.Println("Saving AOF record")
-		state.aof.w.Write(v)
-
-		if state.conf.aofFsync == Always {
-			state.aof.w.Flush()
-		}
+		state.aof.Append(v)
 	}
 
 	// If there are RDB snapshots, increment the keys
@@ -207,11 +255,6 @@ func exists(client *Client, v *Value, state *AppState) *Value {
 func keys(client *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
 
-	// KEYS can only take 1 argument
-	if len(args) > 1 {
-		return &Value{typ: ERROR, err: "ERR Invalid number of arguments for 'KEYS' command"}
-	}
-
 	pattern := args[0].bulk
 
 	DB.mu.RLock()
@@ -221,7 +264,7 @@ func keys(client *Client, v *Value, state *AppState) *Value {
 	for key := range DB.store {
 		matched, err := filepath.Match(pattern, key) // Can use this to offload some of the pattern-matching difficulty
 		if err != nil {
-			log.Printf("Error matching keys: (pattern: %s), (key: %s) - %v", pattern, key, err)
+			log.Printf("Error matching keys: (pattern: %s), (key: %s) - %v", repr(pattern), repr(key), err)
 			continue
 		}
 
@@ -248,7 +291,9 @@ func keys(client *Client, v *Value, state *AppState) *Value {
 // save is considered to be blocking because it uses
 // the `SaveRDB` function, which has a `RLock` on its critical section
 func save(client *Client, v *Value, state *AppState) *Value {
-	SaveRDB(state)
+	if err := SaveRDB(state); err != nil {
+		return &Value{typ: ERROR, err: "ERR " + err.Error()}
+	}
 	return &Value{typ: STRING, str: "OK"}
 }
 
@@ -258,20 +303,16 @@ func bgsave(client *Client, v *Value, state *AppState) *Value {
 		return &Value{typ: ERROR, err: "ERR Background saving already happening"}
 	}
 
-	// Make a local copy of the DB
-	copy := make(map[string]*Item, len(DB.store))
-	DB.mu.RLock()
-	maps.Copy(copy, DB.store)
-	DB.mu.RUnlock()
-
 	state.bgSaveRunning = true
-	state.dbCopy = copy
+	state.dbCopy = DB.snapshot()
+	state.librariesCopy = state.scripts.LibraryCodes()
 
 	// Save to DB in another thread. Whenever the goroutine finishes, reset the BGSAVE state variables
 	go func() {
 		defer func() {
 			state.bgSaveRunning = false
 			state.dbCopy = nil
+			state.librariesCopy = nil
 		}()
 
 		SaveRDB(state)
@@ -285,6 +326,7 @@ func flushdb(client *Client, v *Value, state *AppState) *Value {
 	// Instead of linearly going through each key and deleting it,
 	// just set the DB to a new, empty map
 	DB.mu.Lock()
+	DB.touchAll()
 	DB.store = map[string]*Item{}
 	DB.expiringStore = map[string]*Item{}
 	DB.mu.Unlock()
@@ -303,9 +345,6 @@ func dbsize(client *Client, v *Value, state *AppState) *Value {
 // auth handles the case of AUTH Redis messages
 func auth(client *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR Invalid number of arguments for 'AUTH' command"}
-	}
 
 	password := args[0].bulk
 	if state.conf.password == password {
@@ -317,12 +356,168 @@ func auth(client *Client, v *Value, state *AppState) *Value {
 	}
 }
 
+// hello handles the case of HELLO Redis messages.
+// It switches the client to the given RESP version, optionally authenticating and naming it on the way
+func hello(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	proto := client.proto
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR Protocol version is not an integer or out of range"}
+		}
+		if ver != 2 && ver != 3 {
+			return &Value{typ: ERROR, err: "NOPROTO unsupported protocol version"}
+		}
+		proto = ver
+		args = args[1:]
+	}
+
+	name, hasName := "", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "AUTH":
+			// AUTH username password. There are no ACL users, so only the default user exists
+			if i+2 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR Syntax error in HELLO option 'AUTH'"}
+			}
+			if args[i+1].bulk != "default" || state.conf.password != args[i+2].bulk {
+				return &Value{typ: ERROR, err: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+			client.authenticated = true
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR Syntax error in HELLO option 'SETNAME'"}
+			}
+			if !validClientName(args[i+1].bulk) {
+				return &Value{typ: ERROR, err: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+			name, hasName = args[i+1].bulk, true
+			i++
+		default:
+			return &Value{typ: ERROR, err: "ERR Syntax error in HELLO option '" + args[i].bulk + "'"}
+		}
+	}
+
+	// HELLO can be sent before authenticating, but only to authenticate
+	if state.conf.requirepass && !client.authenticated {
+		return &Value{typ: ERROR, err: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	// Only switch once every option is known to be valid. HELLO's own reply uses the new version
+	client.proto = proto
+	client.out.SetProto(proto)
+	if hasName {
+		client.name = name
+	}
+
+	return &Value{typ: MAP, array: []Value{
+		{typ: BULK, bulk: "server"}, {typ: BULK, bulk: "redis"},
+		{typ: BULK, bulk: "version"}, {typ: BULK, bulk: version},
+		{typ: BULK, bulk: "proto"}, {typ: INTEGER, num: proto},
+		{typ: BULK, bulk: "id"}, {typ: INTEGER, num: int(client.id)},
+		{typ: BULK, bulk: "mode"}, {typ: BULK, bulk: "standalone"},
+		{typ: BULK, bulk: "role"}, {typ: BULK, bulk: "master"},
+		{typ: BULK, bulk: "modules"}, {typ: ARRAY, array: []Value{}},
+	}}
+}
+
+// unknownCommand creates the error sent for commands that aren't in the command table
+func unknownCommand(v *Value) *Value {
+	msg := "ERR unknown command '" + v.array[0].bulk + "', with args beginning with: "
+	for _, arg := range v.array[1:] {
+		msg += "'" + arg.bulk + "' "
+	}
+	return &Value{typ: ERROR, err: msg}
+}
+
+// outOfMemory tries to free memory if the DB uses more than maxmemory, and checks if it still does.
+// Must be called with the command lock held
+func outOfMemory(state *AppState) bool {
+	if state.conf.maxmem <= 0 {
+		return false
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	if DB.mem < state.conf.maxmem {
+		return false
+	}
+	DB.evictKeys(state, 0)
+	return DB.mem >= state.conf.maxmem
+}
+
+// ping handles the case of PING Redis messages
+func ping(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+	if len(args) > 1 {
+		return wrongArgs("ping")
+	}
+
+	// RESP2 clients subscribed to channels get the reply in the same shape as messages
+	if client.proto == 2 && len(client.subscriptions) > 0 {
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0].bulk
+		}
+		return bulkArray([]string{"pong", msg})
+	}
+
+	if len(args) == 1 {
+		return &Value{typ: BULK, bulk: args[0].bulk}
+	}
+	return &Value{typ: STRING, str: "PONG"}
+}
+
+// echo handles the case of ECHO Redis messages
+func echo(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	return &Value{typ: BULK, bulk: args[0].bulk}
+}
+
+// quit handles the case of QUIT Redis messages. The connection is closed once the reply is sent
+func quit(client *Client, v *Value, state *AppState) *Value {
+	client.closeAfterReply = true
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// reset handles the case of RESET Redis messages.
+// It puts the client back in the state of a new connection
+func reset(client *Client, v *Value, state *AppState) *Value {
+	client.transaction = nil
+	DB.mu.Lock()
+	DB.unwatch(client)
+	DB.mu.Unlock()
+
+	state.removeMonitor(client)
+	state.unsubscribeAll(client)
+	DB.disableTracking(client)
+
+	client.proto = 2
+	client.out.SetProto(2)
+	client.name = ""
+	client.authenticated = !state.conf.requirepass
+
+	return &Value{typ: STRING, str: "RESET"}
+}
+
+// validClientName checks that a client name has no spaces, newlines or other special characters
+func validClientName(name string) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 // expire handles the case of EXPIRE Redis messages
 func expire(client *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 2 {
-		return &Value{typ: ERROR, err: "ERR Invalid number of arguments for 'EXPIRE' command"}
-	}
 
 	keyToExpire := args[0].bulk
 	expiry := args[1].bulk
@@ -335,14 +530,16 @@ func expire(client *Client, v *Value, state *AppState) *Value {
 
 	// Try to get the given key from the DB if it exists. If not, return 0.
 	// If it does exist, set its expiry to `expirySeconds` seconds from now
-	DB.mu.RLock()
+	DB.mu.Lock()
 	key, ok := DB.store[keyToExpire]
 	if !ok {
+		DB.mu.Unlock()
 		return &Value{typ: INTEGER, num: 0}
 	}
 	key.Exp = time.Now().Add(time.Second * time.Duration(expirySeconds))
 	DB.expiringStore[keyToExpire] = &Item{V: key.V, Exp: key.Exp}
-	DB.mu.RUnlock()
+	DB.touch(keyToExpire)
+	DB.mu.Unlock()
 
 	return &Value{typ: INTEGER, num: 1}
 }
@@ -350,9 +547,6 @@ func expire(client *Client, v *Value, state *AppState) *Value {
 // ttl handles the case of TTL Redis messages
 func ttl(client *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR Invalid number of arguments for 'TTL' command"}
-	}
 
 	keyToTTL := args[0].bulk
 
@@ -387,17 +581,21 @@ func ttl(client *Client, v *Value, state *AppState) *Value {
 
 // bgrewriteaof handles the case of BGREWRITEAOF Redis messages
 func bgrewriteaof(client *Client, v *Value, state *AppState) *Value {
+	// AOF can be turned off at runtime, so keep rewriting the one that's open now
+	aof := state.aof
+	if aof == nil {
+		return &Value{typ: ERROR, err: "ERR Background AOF rewriting is only possible when appendonly is yes"}
+	}
+
+	// Copy the DB now, so the rewrite is of the DB as it was when the command ran
+	copy := DB.snapshot()
+	libraries := state.scripts.LibraryCodes()
+
 	// Start a new thread to let this be a background process
 	go func() {
-		// Copy the DB into a local variable
-		DB.mu.RLock()
-		copy := make(map[string]*Item, len(DB.store))
-		maps.Copy(copy, DB.store)
-		DB.mu.RUnlock()
-
 		// Start the rewriting
 		state.aofRewriteRunning = true
-		state.aof.Rewrite(copy)
+		aof.Rewrite(copy, libraries)
 		state.aofRewriteRunning = false
 
 		state.aofStats.aof_rewrites++
@@ -408,8 +606,8 @@ func bgrewriteaof(client *Client, v *Value, state *AppState) *Value {
 
 // multi handles the case of MULTI Redis messages
 func multi(client *Client, v *Value, state *AppState) *Value {
-	// Create a new transaction for the current app state
-	state.transaction = NewTransaction()
+	// Create a new transaction for the current client
+	client.transaction = NewTransaction()
 
 	return &Value{typ: STRING, str: "OK"}
 }
@@ -417,14 +615,41 @@ func multi(client *Client, v *Value, state *AppState) *Value {
 // _exec handles the case of EXEC Redis messages
 func _exec(client *Client, v *Value, state *AppState) *Value {
 	// Can't EXEC a non-existent MULTI
-	if state.transaction == nil {
+	if client.transaction == nil {
 		return &Value{typ: ERROR, err: "ERR EXEC without active MULTI"}
 	}
 
+	// If any watched key was modified or has expired since WATCH, abort the transaction
+	DB.mu.Lock()
+	aborted := client.dirty || DB.watchedKeyExpired(client)
+	DB.unwatch(client)
+	DB.mu.Unlock()
+
+	if aborted {
+		client.transaction = nil
+		return &Value{typ: NULLARRAY}
+	}
+
+	// If a command was rejected while queueing, none of them run
+	if client.transaction.failed {
+		client.transaction = nil
+		return &Value{typ: ERROR, err: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	// Wrap the writes of the transaction in MULTI/EXEC in the AOF, so they are replayed all or nothing
+	if state.conf.aofEnabled {
+		state.aof.BeginBatch()
+		defer state.aof.EndBatch()
+	}
+
 	// Get a list of the replies to each command
-	replies := make([]Value, len(state.transaction.commands))
-	for i, cmd := range state.transaction.commands {
-		reply := cmd.handler(client, cmd.v, state)
+	replies := make([]Value, len(client.transaction.commands))
+	for i, cmd := range client.transaction.commands {
+		reply := cmd.command.handler(client, cmd.v, state)
+		if reply == nil {
+			reply = &Value{typ: NULL} // Blocking commands never block inside MULTI/EXEC, so nil can't mean blocked
+		}
+		DB.rememberKeys(client, cmd.command, cmd.v)
 		// Direct assignment preferred over append() for performance
 		// because we already have size of final list. No need for constant reallocation
 		replies[i] = *reply
@@ -432,7 +657,7 @@ func _exec(client *Client, v *Value, state *AppState) *Value {
 
 	reply := Value{typ: ARRAY, array: replies}
 
-	state.transaction = nil // End the transaction
+	client.transaction = nil // End the transaction
 
 	return &reply
 }
@@ -440,12 +665,37 @@ func _exec(client *Client, v *Value, state *AppState) *Value {
 // discard handles the case of DISCARD Redis messages
 func discard(client *Client, v *Value, state *AppState) *Value {
 	// Can't discard a MULTI if there is no MULTI
-	if state.transaction == nil {
+	if client.transaction == nil {
 		return &Value{typ: ERROR, err: "ERR DISCARD without active MULTI"}
 	}
 
-	// Delete current MULTI
-	state.transaction = nil
+	// Delete current MULTI and forget about any watched keys
+	client.transaction = nil
+	DB.mu.Lock()
+	DB.unwatch(client)
+	DB.mu.Unlock()
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// watch handles the case of WATCH Redis messages
+func watch(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	DB.mu.Lock()
+	for _, arg := range args {
+		DB.watch(client, arg.bulk)
+	}
+	DB.mu.Unlock()
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// unwatch handles the case of UNWATCH Redis messages
+func unwatch(client *Client, v *Value, state *AppState) *Value {
+	DB.mu.Lock()
+	DB.unwatch(client)
+	DB.mu.Unlock()
 
 	return &Value{typ: STRING, str: "OK"}
 }
@@ -460,5 +710,5 @@ func monitor(client *Client, v *Value, state *AppState) *Value {
 // info handles the case of INFO Redis messages
 func info(client *Client, v *Value, state *AppState) *Value {
 	msg := "\n" + state.info.print(state)
-	return &Value{typ: BULK, bulk: msg}
+	return &Value{typ: VERBATIM, format: "txt", bulk: msg}
 }
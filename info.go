@@ -37,17 +37,28 @@ func (info *Info) build(state *AppState) {
 	}
 
 	info.server = map[string]string{
-		"redis_version":     "0.1.0",
+		"redis_version":     version,
 		"process_id":        fmt.Sprint(os.Getpid()),
-		"tcp_port":          "6379",
+		"tcp_port":          fmt.Sprint(state.conf.port),
 		"server_time_usec":  fmt.Sprint(time.Now().UnixMicro()),
 		"uptime_in_seconds": fmt.Sprint(int(time.Since(state.serverStart).Seconds())),
 		"executable":        execPath,
 		"config_file":       state.conf.config_file,
 	}
+	for i, listener := range listenerInfo(state.conf) {
+		info.server[fmt.Sprintf("listener%d", i)] = listener
+	}
+
+	state.clientsMu.Lock()
+	connectedClients := len(state.clients)
+	state.clientsMu.Unlock()
 
 	info.client = map[string]string{
-		"connected_clients": fmt.Sprint(state.clientCount),
+		"connected_clients": fmt.Sprint(connectedClients),
+		"maxclients":        fmt.Sprint(state.conf.maxclients),
+		"timeout":           fmt.Sprint(state.conf.timeout),
+		"tcp_keepalive":     fmt.Sprint(state.conf.tcpKeepalive),
+		"blocked_clients":   fmt.Sprint(state.blockedClients),
 	}
 
 	info.memory = map[string]string{
@@ -68,10 +79,12 @@ func (info *Info) build(state *AppState) {
 	}
 
 	info.general = map[string]string{
-		"total_connections_received": fmt.Sprint(state.generalStats.total_connections_received),
-		"total_commands_processed":   fmt.Sprint(state.generalStats.total_commands_processed),
-		"evicted_keys":               fmt.Sprint(state.generalStats.evicted_keys),
-		"expired_keys":               fmt.Sprint(state.generalStats.expired_keys),
+		"total_connections_received":                fmt.Sprint(state.generalStats.total_connections_received.Load()),
+		"rejected_connections":                      fmt.Sprint(state.generalStats.rejected_connections.Load()),
+		"client_output_buffer_limit_disconnections": fmt.Sprint(state.generalStats.client_output_buffer_limit_disconnections.Load()),
+		"total_commands_processed":                  fmt.Sprint(state.generalStats.total_commands_processed.Load()),
+		"evicted_keys":                              fmt.Sprint(state.generalStats.evicted_keys.Load()),
+		"expired_keys":                              fmt.Sprint(state.generalStats.expired_keys.Load()),
 	}
 }
 
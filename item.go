@@ -5,6 +5,7 @@ import "time"
 // Creating a key allows us to store expiry time
 type Item struct {
 	V          string
+	List       []string // Only set for list keys. Empty lists are deleted, so a list key always has elements
 	Exp        time.Time
 	LastAccess time.Time
 	Accesses   int
@@ -21,5 +22,21 @@ func (item *Item) approxMemUsage(name string) int64 {
 	expiryHeaderSize := 24
 	mapEntrySize := 32 // Structs are basically maps which have their own headers
 
-	return int64(stringHeaderSize + len(name) + stringHeaderSize + len(item.V) + expiryHeaderSize + mapEntrySize)
+	var listSize int64
+	for _, elem := range item.List {
+		listSize += elemMemUsage(elem)
+	}
+
+	return int64(stringHeaderSize+len(name)+stringHeaderSize+len(item.V)+expiryHeaderSize+mapEntrySize) + listSize
+}
+
+// elemMemUsage approximates the memory usage of a single element of a list
+func elemMemUsage(elem string) int64 {
+	stringHeaderSize := 16 // Bytes
+	return int64(stringHeaderSize + len(elem))
+}
+
+// isList checks whether the item holds a list rather than a string
+func (item *Item) isList() bool {
+	return item.List != nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// listen opens every endpoint in the config: a TCP listener for each bind address, unless the port is 0,
+// a TLS listener for each bind address if the TLS port is set, and a Unix socket if one is set
+func listen(conf *Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	if conf.port != 0 {
+		tcpListeners, err := listenTCP(conf.bind, conf.port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, tcpListeners...)
+	}
+
+	if conf.tlsPort != 0 {
+		if err := conf.loadTLS(); err != nil {
+			closeAll()
+			return nil, err
+		}
+		tlsListeners, err := listenTCP(conf.bind, conf.tlsPort)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// The TLS config is looked up for every connection, so CONFIG SET can reload it
+		for _, l := range tlsListeners {
+			log.Println("Accepting TLS connections on ", l.Addr().String())
+			listeners = append(listeners, tls.NewListener(l, &tls.Config{GetConfigForClient: conf.currentTLSConfig}))
+		}
+	}
+
+	if conf.unixsocket != "" {
+		// A socket file left behind by a previous run would make listening fail
+		os.Remove(conf.unixsocket)
+
+		l, err := net.Listen("unix", conf.unixsocket)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if conf.unixsocketperm != 0 {
+			if err := os.Chmod(conf.unixsocket, conf.unixsocketperm); err != nil {
+				l.Close()
+				closeAll()
+				return nil, err
+			}
+		}
+		log.Println("Listening on Unix socket ", conf.unixsocket)
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no addresses to listen on, set a port and bind address or a unixsocket")
+	}
+	return listeners, nil
+}
+
+// listenTCP listens on the port of every bind address. Bind addresses starting with "-" are optional,
+// so failing to bind them (like IPv6 on a host without it) only logs a warning
+func listenTCP(bind []string, port int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range bind {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+
+		network, host := bindNetwork(addr)
+		l, err := net.Listen(network, net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			if optional {
+				log.Printf("Skipping optional bind address %s: %v", addr, err)
+				continue
+			}
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		log.Println("Listening on ", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// bindNetwork picks the network to listen on for a bind address. "*" means every IPv4 address and "::*" every IPv6 one.
+// IPv4 and IPv6 addresses are listened on separately, so "*" and "::*" can be bound at the same time
+func bindNetwork(addr string) (network, host string) {
+	switch addr {
+	case "*":
+		return "tcp4", "0.0.0.0"
+	case "::*":
+		return "tcp6", "::"
+	}
+
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return "tcp", addr // A host name, like localhost
+	case ip.To4() != nil:
+		return "tcp4", addr
+	default:
+		return "tcp6", addr
+	}
+}
+
+// The file descriptors kept for things other than clients, like the listeners and the AOF and RDB files
+const reservedFds = 32
+
+// clientsLimit raises the open files limit so maxclients clients can connect, and returns how many clients
+// the limit allows, which is less than maxclients if it couldn't be raised far enough
+func clientsLimit(maxclients int) (int, error) {
+	limit, err := raiseOpenFilesLimit(uint64(maxclients) + reservedFds)
+	if err != nil {
+		return maxclients, err
+	}
+	if limit >= uint64(maxclients)+reservedFds {
+		return maxclients, nil
+	}
+	return max(int(limit)-reservedFds, 0), nil
+}
+
+// adjustMaxclients lowers maxclients at startup if the open files limit is too low for it, like Redis does,
+// so running out of file descriptors turns into rejecting clients. Exits if there's no room for any client
+func adjustMaxclients(conf *Config) {
+	fits, err := clientsLimit(conf.maxclients)
+	if err != nil {
+		log.Println("Unable to obtain the open files limit, assuming it's enough for maxclients: ", err)
+		return
+	}
+	if fits == conf.maxclients {
+		return
+	}
+	if fits < 1 {
+		log.Fatalf("Your current 'ulimit -n' is not enough for the server to start. Please increase your open file limit to at least %d. Exiting.", reservedFds+1)
+	}
+
+	log.Printf("You requested maxclients of %d requiring at least %d max file descriptors. "+
+		"maxclients has been reduced to %d to compensate for low ulimit. If you need higher maxclients increase 'ulimit -n'.",
+		conf.maxclients, conf.maxclients+reservedFds, fits)
+	conf.maxclients = fits
+}
+
+// applyMaxclients raises the open files limit after CONFIG SET maxclients, refusing values it can't be raised enough for
+func applyMaxclients(state *AppState) error {
+	fits, err := clientsLimit(state.conf.maxclients)
+	if err == nil && fits < state.conf.maxclients {
+		return fmt.Errorf("The operating system is not able to handle the specified number of clients, try with %d", fits)
+	}
+	return nil
+}
+
+// acceptConns accepts connections on a listener until it's closed, and handles each client in its own goroutine
+func acceptConns(l net.Listener, state *AppState) {
+	var delay time.Duration // How long to wait before accepting again after an error
+	for {
+		// Block until connection is made
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return // Shutting down
+		}
+		if err != nil {
+			// Most likely out of file descriptors, so wait for clients to disconnect instead of giving up
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("Accepting connection failed, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		// Client IDs are given out in the order connections are accepted
+		client := NewClient(state.nextClientID.Add(1), conn)
+
+		// Let the client know why it's turned away before hanging up
+		if !state.addClient(client) {
+			log.Println("Rejecting connection, max number of clients reached: ", conn.RemoteAddr().String())
+			client.out.Write(&Value{typ: ERROR, err: "ERR max number of clients reached"})
+			client.out.Flush()
+			conn.Close()
+			continue
+		}
+
+		// Clients that connect while no password is set stay authenticated if one is set later, like in Redis
+		state.conf.mu.RLock()
+		setKeepAlive(conn, state.conf.tcpKeepalive)
+		client.authenticated = !state.conf.requirepass
+		state.conf.mu.RUnlock()
+
+		// Wait for 1 goroutine to finish
+		go func() {
+			handleConn(client, state)
+		}()
+	}
+}
+
+// listenerInfo describes the endpoints the server listens on, the way INFO shows them
+func listenerInfo(conf *Config) []string {
+	var listeners []string
+	if conf.port != 0 && len(conf.bind) > 0 {
+		desc := "name=tcp"
+		for _, addr := range conf.bind {
+			desc += ",bind=" + addr
+		}
+		listeners = append(listeners, desc+fmt.Sprintf(",port=%d", conf.port))
+	}
+	if conf.tlsPort != 0 && len(conf.bind) > 0 {
+		desc := "name=tls"
+		for _, addr := range conf.bind {
+			desc += ",bind=" + addr
+		}
+		listeners = append(listeners, desc+fmt.Sprintf(",port=%d", conf.tlsPort))
+	}
+	if conf.unixsocket != "" {
+		listeners = append(listeners, "name=unix,bind="+conf.unixsocket)
+	}
+	return listeners
+}
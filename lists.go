@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Returned when a command is used on a key holding another type of value, like GET on a list
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// errorReply creates an error reply from an error returned by the DB
+func errorReply(err error) *Value {
+	if errors.Is(err, ErrWrongType) {
+		return &Value{typ: ERROR, err: err.Error()}
+	}
+	return &Value{typ: ERROR, err: "ERR " + err.Error()}
+}
+
+// pushList pushes the given elements to the head (left) or tail (right) of the list stored at the given key,
+// creating the list if needed. It returns the length of the list after the push.
+// Must be called with the DB lock held
+func (db *Database) pushList(key string, elems []string, left bool, state *AppState) (int, error) {
+	if item, ok := db.lookup(key, state); ok && !item.isList() {
+		return 0, ErrWrongType
+	}
+
+	var added int64
+	for _, elem := range elems {
+		added += elemMemUsage(elem)
+	}
+
+	// Check if we would be out of memory from this
+	outOfMemory := state.conf.maxmem > 0 && db.mem+added >= state.conf.maxmem
+	if outOfMemory {
+		if err := db.evictKeys(state, added); err != nil {
+			return 0, err
+		}
+	}
+
+	// Evicting may have deleted the list, so look it up again
+	item, ok := db.lookup(key, state)
+	if !ok {
+		item = &Item{List: []string{}}
+		db.store[key] = item
+		db.mem += item.approxMemUsage(key)
+	}
+
+	if left {
+		// Each element is pushed to the head one after the other, so they end up in reverse order
+		head := slices.Clone(elems)
+		slices.Reverse(head)
+		item.List = append(head, item.List...)
+	} else {
+		item.List = append(item.List, elems...)
+	}
+
+	db.mem += added
+	if db.mem > state.peakMem {
+		state.peakMem = db.mem
+	}
+
+	db.touch(key)
+	db.signalKeyAsReady(key)
+
+	return len(item.List), nil
+}
+
+// popList pops up to count elements from the head (left) or tail (right) of the list stored
+// at the given key. The list is deleted once it's empty. Must be called with the DB lock held
+func (db *Database) popList(key string, left bool, count int, state *AppState) ([]string, error) {
+	item, ok := db.lookup(key, state)
+	if !ok {
+		return nil, nil
+	}
+	if !item.isList() {
+		return nil, ErrWrongType
+	}
+
+	n := min(count, len(item.List))
+	var popped []string
+	if left {
+		popped = slices.Clone(item.List[:n])
+		item.List = item.List[n:]
+	} else {
+		popped = slices.Clone(item.List[len(item.List)-n:])
+		slices.Reverse(popped) // Popping from the tail returns the last element first
+		item.List = item.List[:len(item.List)-n]
+	}
+
+	for _, elem := range popped {
+		db.mem -= elemMemUsage(elem)
+	}
+
+	if len(item.List) == 0 {
+		db.Delete(key)
+	} else {
+		db.touch(key)
+	}
+
+	return popped, nil
+}
+
+// moveList pops an element from one end of the source list and pushes it to one end of the destination list.
+// It returns the moved element, or false if the source list doesn't exist. Must be called with the DB lock held
+func (db *Database) moveList(src, dst string, fromLeft, toLeft bool, state *AppState) (string, bool, error) {
+	// Make sure the destination is a list before popping anything
+	if item, ok := db.lookup(dst, state); ok && !item.isList() {
+		return "", false, ErrWrongType
+	}
+
+	popped, err := db.popList(src, fromLeft, 1, state)
+	if err != nil || len(popped) == 0 {
+		return "", false, err
+	}
+
+	if _, err := db.pushList(dst, popped, toLeft, state); err != nil {
+		return "", false, err
+	}
+
+	return popped[0], true, nil
+}
+
+// parseDirection parses the LEFT or RIGHT arguments of list commands
+func parseDirection(arg string) (left bool, ok bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// lpush handles the case of LPUSH Redis messages
+func lpush(client *Client, v *Value, state *AppState) *Value {
+	return push(client, v, state, true)
+}
+
+// rpush handles the case of RPUSH Redis messages
+func rpush(client *Client, v *Value, state *AppState) *Value {
+	return push(client, v, state, false)
+}
+
+// push pushes elements to a list for both LPUSH and RPUSH
+func push(client *Client, v *Value, state *AppState, left bool) *Value {
+	args := v.array[1:]
+
+	elems := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		elems[i] = arg.bulk
+	}
+
+	DB.mu.Lock()
+	length, err := DB.pushList(args[0].bulk, elems, left, state)
+	DB.mu.Unlock()
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// If AOF is enabled, write to its buffer
+	if state.conf.aofEnabled {
+		state.aof.Append(v)
+	}
+	IncrementRDBTrackers()
+
+	return &Value{typ: INTEGER, num: length}
+}
+
+// lpop handles the case of LPOP Redis messages
+func lpop(client *Client, v *Value, state *AppState) *Value {
+	return pop(client, v, state, true)
+}
+
+// rpop handles the case of RPOP Redis messages
+func rpop(client *Client, v *Value, state *AppState) *Value {
+	return pop(client, v, state, false)
+}
+
+// pop pops elements from a list for both LPOP and RPOP. Without a count, a single element is returned.
+// With a count, an array of up to that many elements is returned
+func pop(client *Client, v *Value, state *AppState, left bool) *Value {
+	args := v.array[1:]
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs(v.array[0].bulk)
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return &Value{typ: ERROR, err: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	DB.mu.Lock()
+	popped, err := DB.popList(args[0].bulk, left, count, state)
+	DB.mu.Unlock()
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(popped) == 0 {
+		// Asking for a count gets a null array instead of a null bulk string
+		if len(args) == 2 {
+			return &Value{typ: NULLARRAY}
+		}
+		return &Value{typ: NULL}
+	}
+
+	if state.conf.aofEnabled {
+		state.aof.Append(v)
+	}
+	IncrementRDBTrackers()
+
+	if len(args) == 1 {
+		return &Value{typ: BULK, bulk: popped[0]}
+	}
+	return bulkArray(popped)
+}
+
+// bulkArray creates an array reply of bulk strings
+func bulkArray(items []string) *Value {
+	reply := Value{typ: ARRAY, array: make([]Value, len(items))}
+	for i, item := range items {
+		reply.array[i] = Value{typ: BULK, bulk: item}
+	}
+	return &reply
+}
+
+// llen handles the case of LLEN Redis messages
+func llen(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	item, ok := DB.lookup(args[0].bulk, state)
+	if !ok {
+		return &Value{typ: INTEGER, num: 0}
+	}
+	if !item.isList() {
+		return errorReply(ErrWrongType)
+	}
+	return &Value{typ: INTEGER, num: len(item.List)}
+}
+
+// lrange handles the case of LRANGE Redis messages. Negative indexes count from the end of the list
+func lrange(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+	}
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	item, ok := DB.lookup(args[0].bulk, state)
+	if !ok {
+		return &Value{typ: ARRAY}
+	}
+	if !item.isList() {
+		return errorReply(ErrWrongType)
+	}
+
+	length := len(item.List)
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+	if start > stop {
+		return &Value{typ: ARRAY}
+	}
+
+	return bulkArray(item.List[start : stop+1])
+}
+
+// lmove handles the case of LMOVE Redis messages
+func lmove(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	fromLeft, ok1 := parseDirection(args[2].bulk)
+	toLeft, ok2 := parseDirection(args[3].bulk)
+	if !ok1 || !ok2 {
+		return &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	reply := tryMove(args[0].bulk, args[1].bulk, fromLeft, toLeft, v, state)
+	if reply == nil {
+		return &Value{typ: NULL}
+	}
+	return reply
+}
+
+// tryMove moves an element between lists for both LMOVE and BLMOVE. It returns nil if the source list
+// doesn't exist. The given command is what gets written to the AOF
+func tryMove(src, dst string, fromLeft, toLeft bool, v *Value, state *AppState) *Value {
+	DB.mu.Lock()
+	elem, ok, err := DB.moveList(src, dst, fromLeft, toLeft, state)
+	DB.mu.Unlock()
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return nil
+	}
+
+	if state.conf.aofEnabled {
+		state.aof.Append(v)
+	}
+	IncrementRDBTrackers()
+
+	return &Value{typ: BULK, bulk: elem}
+}
+
+// parseMPopArgs parses the `numkeys key [key...] LEFT|RIGHT [COUNT count]` arguments of LMPOP and BLMPOP
+func parseMPopArgs(args []Value) (keys []string, left bool, count int, errReply *Value) {
+	numKeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, &Value{typ: ERROR, err: "ERR numkeys should be greater than 0"}
+	}
+	if len(args) < numKeys+2 {
+		return nil, false, 0, &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	for _, arg := range args[1 : numKeys+1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	left, ok := parseDirection(args[numKeys+1].bulk)
+	if !ok {
+		return nil, false, 0, &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	count = 1
+	rest := args[numKeys+2:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0].bulk) == "COUNT":
+		count, err = strconv.Atoi(rest[1].bulk)
+		if err != nil || count <= 0 {
+			return nil, false, 0, &Value{typ: ERROR, err: "ERR count should be greater than 0"}
+		}
+	default:
+		return nil, false, 0, &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	return keys, left, count, nil
+}
+
+// lmpop handles the case of LMPOP Redis messages
+func lmpop(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	keys, left, count, errReply := parseMPopArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+
+	reply := tryMPop(keys, left, count, state)
+	if reply == nil {
+		return &Value{typ: NULLARRAY}
+	}
+	return reply
+}
+
+// tryMPop pops up to count elements from the first non-empty list among the given keys, for both LMPOP and BLMPOP.
+// It returns nil if none of the lists exist
+func tryMPop(keys []string, left bool, count int, state *AppState) *Value {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	for _, key := range keys {
+		popped, err := DB.popList(key, left, count, state)
+		if err != nil {
+			return errorReply(err)
+		}
+		if len(popped) == 0 {
+			continue
+		}
+
+		// Only the list that was actually popped from is written to the AOF
+		if state.conf.aofEnabled {
+			direction := "RIGHT"
+			if left {
+				direction = "LEFT"
+			}
+			state.aof.Append(bulkArray([]string{"LMPOP", "1", key, direction, "COUNT", strconv.Itoa(count)}))
+		}
+		IncrementRDBTrackers()
+
+		return &Value{typ: ARRAY, array: []Value{{typ: BULK, bulk: key}, *bulkArray(popped)}}
+	}
+
+	return nil
+}
+
+// blpop handles the case of BLPOP Redis messages
+func blpop(client *Client, v *Value, state *AppState) *Value {
+	return blockingPop(client, v, state, true)
+}
+
+// brpop handles the case of BRPOP Redis messages
+func brpop(client *Client, v *Value, state *AppState) *Value {
+	return blockingPop(client, v, state, false)
+}
+
+// blockingPop pops an element from the first non-empty list among the given keys for both BLPOP and BRPOP.
+// If they're all empty, the client is blocked until an element is pushed to one of them or the timeout runs out
+func blockingPop(client *Client, v *Value, state *AppState, left bool) *Value {
+	args := v.array[1:]
+
+	timeout, errReply := parseTimeout(args[len(args)-1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+
+	var keys []string
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	try := func() *Value {
+		DB.mu.Lock()
+		defer DB.mu.Unlock()
+
+		for _, key := range keys {
+			popped, err := DB.popList(key, left, 1, state)
+			if err != nil {
+				return errorReply(err)
+			}
+			if len(popped) == 0 {
+				continue
+			}
+
+			// Written to the AOF as the equivalent non-blocking pop
+			if state.conf.aofEnabled {
+				cmd := "RPOP"
+				if left {
+					cmd = "LPOP"
+				}
+				state.aof.Append(bulkArray([]string{cmd, key}))
+			}
+			IncrementRDBTrackers()
+
+			return bulkArray([]string{key, popped[0]})
+		}
+		return nil
+	}
+
+	return blockOn(client, state, keys, timeout, &Value{typ: NULLARRAY}, try)
+}
+
+// blmove handles the case of BLMOVE Redis messages
+func blmove(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	fromLeft, ok1 := parseDirection(args[2].bulk)
+	toLeft, ok2 := parseDirection(args[3].bulk)
+	if !ok1 || !ok2 {
+		return &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	timeout, errReply := parseTimeout(args[4].bulk)
+	if errReply != nil {
+		return errReply
+	}
+
+	// Written to the AOF as the equivalent LMOVE
+	lmoveCmd := Value{typ: ARRAY, array: append([]Value{{typ: BULK, bulk: "LMOVE"}}, args[:4]...)}
+	try := func() *Value {
+		return tryMove(args[0].bulk, args[1].bulk, fromLeft, toLeft, &lmoveCmd, state)
+	}
+
+	return blockOn(client, state, []string{args[0].bulk}, timeout, &Value{typ: NULL}, try)
+}
+
+// blmpop handles the case of BLMPOP Redis messages
+func blmpop(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	timeout, errReply := parseTimeout(args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+
+	keys, left, count, errReply := parseMPopArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+
+	try := func() *Value {
+		return tryMPop(keys, left, count, state)
+	}
+
+	return blockOn(client, state, keys, timeout, &Value{typ: NULLARRAY}, try)
+}
@@ -1,94 +1,240 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"runtime"
+	"strings"
 	"time"
 )
 
 // The number of seconds since Jan 1 1970
 var UNIX_TIMESTAMP int64 = time.Time{}.Unix()
 
+// The version of the server, as reported by INFO, HELLO and --version
+const version = "0.1.0"
+
+// The config file read when none is given on the command line
+const defaultConfFile = "./redis.conf"
+
+const usage = `Usage: redis-clone [/path/to/redis.conf] [--directive value [value...]...]
+       redis-clone -v or --version
+       redis-clone -h or --help
+
+Settings given as --directive value override the ones in the config file,
+and take the same values. If no config file is given, ./redis.conf is read.
+
+Examples:
+       redis-clone
+       redis-clone /etc/redis/redis.conf
+       redis-clone --port 7000 --appendonly no
+       redis-clone /etc/redis/redis.conf --port 7000 --save 900 1 --save 300 10
+`
+
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "-h", "--help":
+			fmt.Print(usage)
+			return
+		case "-v", "--version":
+			fmt.Printf("redis-clone v=%s go=%s\n", version, runtime.Version())
+			return
+		}
+	}
+
+	confFile, overrides, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+		os.Exit(1)
+	}
+
 	// Read config file
 	log.Println("Reading config file")
-	conf := readConf("./redis.conf")
+	conf, err := readConf(confFile, overrides)
+	var configErr *ConfigError
+	switch {
+	case errors.As(err, &configErr):
+		// Refuse to start with a config that doesn't mean what whoever wrote it thinks it does
+		fmt.Fprintf(os.Stderr, "\n*** FATAL CONFIG FILE ERROR ***\n%v\n", err)
+		os.Exit(1)
+	case err != nil && confFile != defaultConfFile:
+		// A config file given on the command line must be there, while the default one is optional
+		log.Fatalf("Cannot read %s. Quitting: %v", confFile, err)
+	case err != nil:
+		fmt.Printf("Cannot read %s - using default config instead\n", confFile)
+	}
 
+	adjustMaxclients(conf)
 	state := NewAppState(conf)
 
 	if conf.aofEnabled {
 		log.Println("Syncing AOF records")
-		state.aof.Sync(conf.maxmem, conf.eviction, conf.memSamples)
+		state.aof.Sync(state)
 	}
 
 	// If there are any RDB snapshots, save to memory any RDB values saved to the file
 	if len(conf.rdb) > 0 {
-		SyncRDB(conf)
+		SyncRDB(state)
 		InitRDBTrackers(state)
 	}
 
-	// Create a TCP listener on port 6379, the default Redis port
-	l, err := net.Listen("tcp", ":6379")
+	// Listen on every configured endpoint. By default, that's port 6379 on every address
+	listeners, err := listen(conf)
 	if err != nil {
-		log.Fatal("Cannot listen on part 6379. Quitting.")
+		log.Fatal("Cannot listen. Quitting: ", err)
 	}
-	defer l.Close()
-	log.Println("Listening on port 6379")
+	state.listeners = listeners
+	writePidfile(conf)
 
-	for {
-		// Block until connection is made
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+	go state.handleSignals()
+	go state.clientsCron()
+	go state.aofCron()
+
+	for _, l := range listeners[1:] {
+		go acceptConns(l, state)
+	}
+	acceptConns(listeners[0], state)
+
+	// The listeners are only closed on shutdown, which exits once it's done
+	select {}
+}
+
+// parseArgs splits the command line into the config file to read, which is optional and comes first,
+// and config lines built from the --directive value options, like "port 7000" from "--port 7000".
+// A directive takes every argument up to the next one starting with "--", so "--save 900 1" works too
+func parseArgs(args []string) (confFile string, overrides []string, err error) {
+	confFile = defaultConfFile
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		confFile = args[0]
+		args = args[1:]
+	}
+
+	var line []string
+	addLine := func() error {
+		if len(line) == 1 {
+			return fmt.Errorf("Missing value for --%s", line[0])
+		}
+		if len(line) > 0 {
+			overrides = append(overrides, strings.Join(line, " "))
+		}
+		return nil
+	}
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			if err := addLine(); err != nil {
+				return "", nil, err
+			}
+			line = []string{strings.TrimPrefix(arg, "--")}
+			continue
+		}
+		if len(line) == 0 {
+			return "", nil, fmt.Errorf("Unexpected argument '%s'. Settings must be given as --directive value", arg)
 		}
+		line = append(line, arg)
+	}
+	if err := addLine(); err != nil {
+		return "", nil, err
+	}
+
+	return confFile, overrides, nil
+}
 
-		// Wait for 1 goroutine to finish
-		go func() {
-			handleConn(conn, state)
-		}()
+// setKeepAlive turns on TCP keepalives for the connection, so clients that vanish without closing it are noticed.
+// A period of 0 turns them off
+func setKeepAlive(conn net.Conn, secs int) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if secs <= 0 {
+		tcpConn.SetKeepAlive(false)
+		return
 	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(time.Duration(secs) * time.Second)
 }
 
 // handleConn calls the handler associated with the bulk string of the first message in the Value.
 // It then writes the reply from the handler back to the connection.
 // It will continuously read RESP messages from the connection until it is closed
-func handleConn(conn net.Conn, state *AppState) {
+func handleConn(client *Client, state *AppState) {
+	conn := client.conn
 	log.Println("Accepted new connection: ", conn.LocalAddr().String())
-	client := NewClient(conn)
-	reader := bufio.NewReader(conn)
+	reader := client.reader
 
-	// Essentially, removes all clients that aren't monitors
+	// The client was registered once its connection was accepted
 	defer func() {
-		new := state.monitors[:0]
-		for _, monitor := range state.monitors {
-			if monitor != client {
-				new = append(new, monitor)
-			}
-		}
-		state.monitors = new
+		state.clientsMu.Lock()
+		delete(state.clients, client.id)
+		state.clientsMu.Unlock()
 	}()
 
-	state.clientCount++
+	defer conn.Close()
+
+	// Replies the client isn't waiting for, like pub/sub messages, are sent in the background
+	stopFlushing := make(chan struct{})
+	defer close(stopFlushing)
+	go client.out.FlushRequested(stopFlushing)
+
+	// Stop getting MONITOR logs, pub/sub messages and invalidations once the client is gone
+	defer func() {
+		state.lock(nil)
+		state.removeMonitor(client)
+		state.unsubscribeAll(client)
+		DB.disableTracking(client)
+		state.unlock()
+	}()
+
+	// Stop watching keys once the client is gone
 	defer func() {
-		state.clientCount--
+		DB.mu.Lock()
+		DB.unwatch(client)
+		DB.mu.Unlock()
 	}()
 
-	state.generalStats.total_connections_received++
+	state.generalStats.total_connections_received.Add(1)
 
 	for {
+		state.conf.mu.RLock()
+		maxBulkLen := state.conf.protoMaxBulkLen
+		state.conf.mu.RUnlock()
+
 		v := Value{typ: ARRAY}
-		if err := v.readArray(reader); err != nil {
+		if err := v.readArray(reader, maxBulkLen); err != nil {
+			// Let the client know what it did wrong before closing the connection
+			var protoErr *ProtocolError
+			if errors.As(err, &protoErr) {
+				client.out.Write(&Value{typ: ERROR, err: "ERR " + protoErr.Error()})
+				client.out.Flush()
+			}
 			log.Println(err)
 			break
 		}
 
+		// Empty inline commands are ignored
+		if len(v.array) == 0 {
+			continue
+		}
+
 		handle(client, &v, state)
 
-		fmt.Println(v.array)
+		fmt.Println(v.argsRepr())
+
+		// After QUIT, send the reply and close the connection
+		if client.closeAfterReply {
+			client.out.Flush()
+			break
+		}
 	}
 	log.Println("Connection closed: ", conn.LocalAddr().String())
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Pause holds back the commands of every client until it ends, like during a failover. Set by CLIENT PAUSE.
+// A Pause never changes once it's set. Extending it replaces it with a new one
+type Pause struct {
+	all  bool // Whether every command is held back, or only the ones that may write
+	end  time.Time
+	done chan struct{} // Closed when the pause is ended early or replaced
+}
+
+// pausedFor returns the pause the command has to wait for, or nil if it can run.
+// Must be called with the command lock held
+func (state *AppState) pausedFor(client *Client, command *Command, v *Value) *Pause {
+	pause := state.pause
+	if pause == nil {
+		return nil
+	}
+	if !time.Now().Before(pause.end) {
+		state.pause = nil
+		return nil
+	}
+	if pause.all || command.mayWrite(client, v) {
+		return pause
+	}
+	return nil
+}
+
+// writesPaused checks whether writes are paused. While they are, keys aren't expired or evicted,
+// so the dataset doesn't change at all. Must be called with the command lock held
+func (state *AppState) writesPaused() bool {
+	return state.pause != nil && time.Now().Before(state.pause.end)
+}
+
+// wait waits until the pause ends, or it's ended early by CLIENT UNPAUSE or replaced by another CLIENT PAUSE
+func (pause *Pause) wait() {
+	timer := time.NewTimer(time.Until(pause.end))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-pause.done:
+	}
+}
+
+// mayWrite checks whether running the command may write to the DB. Scripts may write unless they're read-only,
+// and EXEC may write if any of the queued commands may
+func (cmd *Command) mayWrite(client *Client, v *Value) bool {
+	cmd = cmd.subcommand(v)
+
+	switch {
+	case cmd.hasFlag(FlagWrite):
+		return true
+	case cmd.hasFlag(FlagMovableKeys) && slices.Contains(cmd.categories, "scripting"):
+		return !cmd.hasFlag(FlagReadOnly)
+	case cmd.name == "exec" && client.transaction != nil:
+		return slices.ContainsFunc(client.transaction.commands, func(queued *TxCommand) bool {
+			return queued.command.mayWrite(client, queued.v)
+		})
+	default:
+		return false
+	}
+}
+
+// clientPause handles CLIENT PAUSE timeout [WRITE|ALL]. If clients are already paused,
+// the pause lasts until the later of the two ends, and holds back every command if either one does
+func clientPause(args []Value, state *AppState) *Value {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("client|pause")
+	}
+
+	ms, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR timeout is not an integer or out of range"}
+	}
+	if ms < 0 {
+		return &Value{typ: ERROR, err: "ERR timeout is negative"}
+	}
+
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1].bulk) {
+		case "ALL":
+		case "WRITE":
+			all = false
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	pause := &Pause{all: all, end: time.Now().Add(time.Duration(ms) * time.Millisecond), done: make(chan struct{})}
+	if old := state.pause; old != nil && time.Now().Before(old.end) {
+		pause.all = pause.all || old.all
+		if old.end.After(pause.end) {
+			pause.end = old.end
+		}
+		// Commands waiting for the old pause start waiting for the new one
+		close(old.done)
+	}
+	state.pause = pause
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// clientUnpause handles CLIENT UNPAUSE, which lets the commands held back by CLIENT PAUSE run right away
+func clientUnpause(state *AppState) *Value {
+	if state.pause != nil {
+		close(state.pause.done)
+		state.pause = nil
+	}
+	return &Value{typ: STRING, str: "OK"}
+}
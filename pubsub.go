@@ -0,0 +1,112 @@
+package main
+
+import (
+	"slices"
+)
+
+// subscribedModeCommands are the only commands RESP2 clients can run once they've subscribed to a channel,
+// since any other reply could be mistaken for a message
+var subscribedModeCommands = []string{"SUBSCRIBE", "UNSUBSCRIBE", "PING", "QUIT", "RESET"}
+
+// subscribe adds the client to the subscribers of a channel, if it isn't one already.
+// Must be called with the command lock held
+func (state *AppState) subscribe(client *Client, channel string) {
+	if slices.Contains(client.subscriptions, channel) {
+		return
+	}
+	client.subscriptions = append(client.subscriptions, channel)
+	state.channels[channel] = append(state.channels[channel], client)
+}
+
+// unsubscribe removes the client from the subscribers of a channel. Must be called with the command lock held
+func (state *AppState) unsubscribe(client *Client, channel string) {
+	client.subscriptions = slices.DeleteFunc(client.subscriptions, func(c string) bool {
+		return c == channel
+	})
+
+	subscribers := slices.DeleteFunc(state.channels[channel], func(c *Client) bool {
+		return c == client
+	})
+	if len(subscribers) == 0 {
+		delete(state.channels, channel)
+	} else {
+		state.channels[channel] = subscribers
+	}
+}
+
+// unsubscribeAll removes the client from the subscribers of every channel. Must be called with the command lock held
+func (state *AppState) unsubscribeAll(client *Client) {
+	for _, channel := range slices.Clone(client.subscriptions) {
+		state.unsubscribe(client, channel)
+	}
+}
+
+// publish sends a message to every subscriber of a channel, returning how many there were.
+// Must be called with the command lock held
+func (state *AppState) publish(channel string, message Value) int {
+	subscribers := state.channels[channel]
+	for _, subscriber := range subscribers {
+		subscriber.push(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: "message"},
+			{typ: BULK, bulk: channel},
+			message,
+		}}, state)
+	}
+	return len(subscribers)
+}
+
+// subscriptionReply creates the reply for subscribing to or unsubscribing from a channel.
+// It has the number of channels the client is still subscribed to
+func subscriptionReply(kind string, channel *Value, count int) *Value {
+	return &Value{typ: PUSH, array: []Value{{typ: BULK, bulk: kind}, *channel, {typ: INTEGER, num: count}}}
+}
+
+// subscribeCmd handles the case of SUBSCRIBE Redis messages.
+// There's a reply for every channel. All but the last are written right away
+func subscribeCmd(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	var reply *Value
+	for i := range args {
+		if reply != nil {
+			client.out.Write(reply)
+		}
+		state.subscribe(client, args[i].bulk)
+		reply = subscriptionReply("subscribe", &args[i], len(client.subscriptions))
+	}
+	return reply
+}
+
+// unsubscribeCmd handles the case of UNSUBSCRIBE Redis messages. Without channels, it unsubscribes from all of them.
+// There's a reply for every channel. All but the last are written right away
+func unsubscribeCmd(client *Client, v *Value, state *AppState) *Value {
+	channels := v.array[1:]
+	if len(channels) == 0 {
+		for _, channel := range client.subscriptions {
+			channels = append(channels, Value{typ: BULK, bulk: channel})
+		}
+	}
+
+	// Unsubscribing from nothing still gets a reply
+	if len(channels) == 0 {
+		return subscriptionReply("unsubscribe", &Value{typ: NULL}, 0)
+	}
+
+	var reply *Value
+	for i := range channels {
+		if reply != nil {
+			client.out.Write(reply)
+		}
+		state.unsubscribe(client, channels[i].bulk)
+		reply = subscriptionReply("unsubscribe", &channels[i], len(client.subscriptions))
+	}
+	return reply
+}
+
+// publishCmd handles the case of PUBLISH Redis messages
+func publishCmd(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	receivers := state.publish(args[0].bulk, Value{typ: BULK, bulk: args[1].bulk})
+	return &Value{typ: INTEGER, num: receivers}
+}
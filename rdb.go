@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log"
 	"os"
@@ -16,6 +17,7 @@ type SnapshotTracker struct {
 	keys   int
 	ticker time.Ticker
 	RDB    RDBSnapshot
+	stop   chan struct{} // Closed to stop the tracker, when the RDB settings change
 }
 
 // NewSnapshotTracker creates a new SnapshotTracker type with the given RDB settings.
@@ -25,11 +27,19 @@ func NewSnapshotTracker(rdb *RDBSnapshot) *SnapshotTracker {
 		keys:   0,
 		ticker: *time.NewTicker(time.Second * time.Duration(rdb.Secs)),
 		RDB:    *rdb,
+		stop:   make(chan struct{}),
 	}
 }
 
 var trackers = []*SnapshotTracker{}
 
+// RDBFile is what gets saved to the RDB file: every key, along with the
+// code of every loaded function library
+type RDBFile struct {
+	Store     map[string]*Item
+	Libraries []string
+}
+
 // InitRDBTrackers initializes the SnapshotTracker types based on the RDB settings from the
 // given Config. It then starts a goroutine for each tracker to keep track of the
 // number of keys changed and save to DB every snapshot.Secs seconds if the number of
@@ -44,9 +54,15 @@ func InitRDBTrackers(state *AppState) {
 		go func() {
 			defer tracker.ticker.Stop()
 
-			// Keep reading the tickers channel until it closes.
+			// Keep reading the tickers channel until the tracker is stopped.
 			// If the number of keys changed is at least the threshold, save to DB
-			for range tracker.ticker.C {
+			for {
+				select {
+				case <-tracker.ticker.C:
+				case <-tracker.stop:
+					return
+				}
+
 				if tracker.keys >= tracker.RDB.KeysChanged {
 					SaveRDB(state)
 				}
@@ -57,6 +73,17 @@ func InitRDBTrackers(state *AppState) {
 	}
 }
 
+// ResetRDBTrackers stops the SnapshotTracker types and starts new ones for the current RDB settings,
+// after CONFIG SET save. Must be called with the command lock held
+func ResetRDBTrackers(state *AppState) {
+	for _, tracker := range trackers {
+		close(tracker.stop)
+	}
+	trackers = nil
+
+	InitRDBTrackers(state)
+}
+
 // IncrementRDBTrackers increments the key count for each SnapshotTracker.
 // This function should be called whenever a key is changed in the database.
 // If the number of keys changed is at least the threshold, the next call to
@@ -67,15 +94,16 @@ func IncrementRDBTrackers() {
 	}
 }
 
-// SaveRDB saves the current state of the database to a file on disk, in bytes
-func SaveRDB(state *AppState) {
+// SaveRDB saves the current state of the database to a file on disk, in bytes.
+// Errors are logged and returned, so SAVE and SHUTDOWN can tell the save failed
+func SaveRDB(state *AppState) error {
 	filepath := path.Join(state.conf.dir, state.conf.rdbFn)
 
 	// Create file if not exists, open for reading or writing, and make sure previous content is overwritten
 	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Println("Error opening RDB file: ", err)
-		return
+		return err
 	}
 	defer f.Close()
 
@@ -83,16 +111,16 @@ func SaveRDB(state *AppState) {
 	// If not, save the actual DB
 	var buffer bytes.Buffer
 	if state.bgSaveRunning {
-		err = gob.NewEncoder(&buffer).Encode(&state.dbCopy)
+		err = gob.NewEncoder(&buffer).Encode(&RDBFile{Store: state.dbCopy, Libraries: state.librariesCopy})
 	} else {
 		DB.mu.RLock()
-		err = gob.NewEncoder(&buffer).Encode(&DB.store)
+		err = gob.NewEncoder(&buffer).Encode(&RDBFile{Store: DB.store, Libraries: state.scripts.LibraryCodes()})
 		DB.mu.RUnlock()
 	}
 
 	if err != nil {
 		log.Println("Error encoding DB to buffer: ", err)
-		return
+		return err
 	}
 
 	// Read the data of the buffer once, so when it's read again
@@ -103,57 +131,70 @@ func SaveRDB(state *AppState) {
 	bufferSum, err := Hash(&buffer)
 	if err != nil {
 		log.Println("RDB - Can't compute buffer checksum: ", err)
-		return
+		return err
 	}
 
 	// Actually save to file
 	_, err = f.Write(data)
 	if err != nil {
 		log.Println("RDB - Can't write to file: ", err)
-		return
+		return err
 	}
 	if err := f.Sync(); /*Force flushing to disk*/ err != nil {
 		log.Println("RDB - Can't flush file to disk: ", err)
-		return
+		return err
 	}
 
 	// Compute the checksum of the file we just saved to for comparison
 	if _, err := f.Seek(0, io.SeekStart); /* Force hash cursor to front of file*/ err != nil {
 		log.Println("RDB - Can't seek file: ", err)
-		return
+		return err
 	}
 	fileSum, err := Hash(f)
 	if err != nil {
 		log.Println("RDB - Can't compute file checksum: ", err)
-		return
+		return err
 	}
 
 	if bufferSum != fileSum {
 		log.Printf("RDB - Buffer and file checksums don't match:\nf=%s\nb=%s\n", fileSum, bufferSum)
-		return
+		return errors.New("RDB file checksum doesn't match")
 	}
 
 	log.Println("Saved RDB file successfully")
 
 	state.rdbStats.rdb_last_save_ts = time.Now().Unix()
 	state.rdbStats.rdb_saves++
+	return nil
 }
 
 // SyncRDB reads the contents of the RDB file and decodes it into the
-// current state of the database
-func SyncRDB(conf *Config) {
-	filepath := path.Join(conf.dir, conf.rdbFn)
-	f, err := os.Open(filepath)
+// current state of the database, loading any function libraries saved with it
+func SyncRDB(state *AppState) {
+	filepath := path.Join(state.conf.dir, state.conf.rdbFn)
+	data, err := os.ReadFile(filepath)
 	if err != nil {
 		log.Println("Error opening RDB file: ", err)
-		f.Close()
 		return
 	}
-	defer f.Close()
 
-	err = gob.NewDecoder(f).Decode(&DB.store)
+	var file RDBFile
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&file)
+	if err != nil {
+		// Older RDB files only contain the keys
+		file = RDBFile{}
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&file.Store)
+	}
 	if err != nil {
 		log.Println("Error decoding RDB file: ", err)
+		return
+	}
+
+	if file.Store != nil {
+		DB.store = file.Store
+	}
+	if err := state.scripts.RestoreLibraries(file.Libraries, "REPLACE"); err != nil {
+		log.Println("Error loading function libraries from RDB file: ", err)
 	}
 }
 
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"testing"
+)
+
+func TestRDBRandomBinary(t *testing.T) {
+	state := newTestState(t, false)
+	r := rand.New(rand.NewSource(3))
+	items := randomItems(r, 200)
+	maps.Copy(DB.store, items)
+
+	if err := SaveRDB(state); err != nil {
+		t.Fatal(err)
+	}
+
+	DB = NewDatabase()
+	SyncRDB(state)
+	checkStore(t, items)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// raiseOpenFilesLimit can't look up the open files limit on this platform, so maxclients is taken as is
+func raiseOpenFilesLimit(want uint64) (uint64, error) {
+	return 0, errors.New("open files limit not supported on this platform")
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// raiseOpenFilesLimit raises the soft limit on open files to want, or as close to it as the hard limit allows.
+// Returns the limit in effect afterwards
+func raiseOpenFilesLimit(want uint64) (uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	if limit.Cur >= want {
+		return limit.Cur, nil
+	}
+
+	raised := limit
+	raised.Cur = min(want, limit.Max)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+		// Keep the limit there was, it's still usable
+		return limit.Cur, nil
+	}
+	return raised.Cur, nil
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// A ScriptEngine holds the Lua interpreters along with the cache of loaded scripts and function libraries.
+// Only one script can run at a time, since scripts run while holding the AppState command lock
+type ScriptEngine struct {
+	L            *lua.LState
+	scripts      map[string]*Script // Keyed by the SHA1 of the script body
+	fL           *lua.LState        // Function libraries get their own interpreter, so SCRIPT FLUSH doesn't affect them
+	libraries    map[string]*Library
+	functions    map[string]*Function
+	mu           sync.Mutex // Protects running, busy and libraryCodes, which are read without holding the AppState lock
+	running      *RunningScript
+	busy         chan struct{} // Closed while a script has been running for longer than lua-time-limit
+	libraryCodes []string
+}
+
+// A Script is a Lua script body along with its compiled form
+type Script struct {
+	body  string
+	proto *lua.FunctionProto
+}
+
+// A RunningScript keeps track of the script currently executing, so that it can be killed
+type RunningScript struct {
+	start  time.Time
+	cancel context.CancelFunc
+	wrote  bool // Scripts that already wrote to the DB can't be killed, or the DB would be left half-modified
+	killed bool
+}
+
+// NewScriptEngine creates a new ScriptEngine with a fresh Lua interpreter and an empty script cache
+func NewScriptEngine() *ScriptEngine {
+	return &ScriptEngine{
+		L:         newLuaState(),
+		scripts:   map[string]*Script{},
+		fL:        newLuaState(),
+		libraries: map[string]*Library{},
+		functions: map[string]*Function{},
+		busy:      make(chan struct{}),
+	}
+}
+
+// newLuaState creates a Lua interpreter with only the libraries that are safe for scripts to use.
+// There is no access to the file system or the OS
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	libs := []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Scripts shouldn't be able to load code from disk, or swap out the environment they run in
+	for _, name := range []string{"dofile", "loadfile", "setfenv"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	// The globals are shared by every script, so none of them can be changed from Lua.
+	// rawset would otherwise get around the read-only tables
+	L.SetGlobal("rawset", L.NewFunction(luaRawSet))
+	for _, name := range []string{lua.TabLibName, lua.StringLibName, lua.MathLibName} {
+		L.SetGlobal(name, readOnlyTable(L, L.GetGlobal(name).(*lua.LTable), modifyReadOnly))
+	}
+	if meta, ok := L.GetMetatable(lua.LString("")).(*lua.LTable); ok {
+		// Strings look up their methods in the real string table, so their metatable must stay out of reach
+		meta.RawSetString("__metatable", lua.LFalse)
+	}
+	L.Env = readOnlyTable(L, L.G.Global, createGlobal)
+	L.SetGlobal("_G", L.Env)
+
+	return L
+}
+
+// newScriptEnv creates the global environment a script or library runs in. Globals are read from
+// the shared read-only ones, and assigning a new global raises an error
+func newScriptEnv(L *lua.LState) *lua.LTable {
+	env := readOnlyTable(L, L.Env, createGlobal)
+	env.RawSetString("_G", env)
+	return env
+}
+
+// readOnlyTable returns an empty table that reads its fields from t. Setting a field calls newindex instead,
+// which raises an error
+func readOnlyTable(L *lua.LState, t *lua.LTable, newindex lua.LGFunction) *lua.LTable {
+	meta := L.NewTable()
+	meta.RawSetString("__index", t)
+	meta.RawSetString("__newindex", L.NewFunction(newindex))
+	meta.RawSetString("__metatable", lua.LFalse)
+	meta.RawSetString("__readonly", lua.LTrue)
+
+	proxy := L.NewTable()
+	L.SetMetatable(proxy, meta)
+	return proxy
+}
+
+// isReadOnly checks whether the given value is a table made by readOnlyTable
+func isReadOnly(t *lua.LTable) bool {
+	meta, ok := t.Metatable.(*lua.LTable)
+	return ok && meta.RawGetString("__readonly") == lua.LTrue
+}
+
+// createGlobal is the __newindex of script environments
+func createGlobal(L *lua.LState) int {
+	L.RaiseError("Script attempted to create global variable '%s'", L.CheckAny(2).String())
+	return 0
+}
+
+// modifyReadOnly is the __newindex of the read-only library tables
+func modifyReadOnly(L *lua.LState) int {
+	L.RaiseError("Attempt to modify a readonly table")
+	return 0
+}
+
+// luaRawSet is rawset, except it can't be used on read-only tables
+func luaRawSet(L *lua.LState) int {
+	t := L.CheckTable(1)
+	if isReadOnly(t) {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}
+	t.RawSet(L.CheckAny(2), L.CheckAny(3))
+	L.Push(t)
+	return 1
+}
+
+// sha1hex returns the hex encoded SHA1 digest of the given string, which is how scripts are identified
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles the given script body and adds it to the script cache. It returns the script's SHA1
+func (engine *ScriptEngine) load(body string) (string, error) {
+	sha := sha1hex(body)
+	if _, ok := engine.scripts[sha]; ok {
+		return sha, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "user_script")
+	if err != nil {
+		return "", err
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", err
+	}
+
+	engine.scripts[sha] = &Script{body: body, proto: proto}
+	return sha, nil
+}
+
+// flush empties the script cache and starts over with a fresh Lua interpreter
+func (engine *ScriptEngine) flush() {
+	engine.scripts = map[string]*Script{}
+	engine.L.Close()
+	engine.L = newLuaState()
+}
+
+// busyChan returns a channel that gets closed if a script runs for longer than lua-time-limit.
+// Clients waiting to run a command stop waiting when that happens, since only SCRIPT KILL is accepted
+func (engine *ScriptEngine) busyChan() <-chan struct{} {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	return engine.busy
+}
+
+// isRunning checks whether a script or function is currently running
+func (engine *ScriptEngine) isRunning() bool {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	return engine.running != nil
+}
+
+// watchTimeLimit closes the busy channel if the running script is still running after the given
+// number of milliseconds. It returns a function to call once the script ends
+func (engine *ScriptEngine) watchTimeLimit(limit int) (stop func()) {
+	if limit <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	timedOut := make(chan bool, 1)
+	go func() {
+		timer := time.NewTimer(time.Duration(limit) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			log.Println("Script has been running for longer than lua-time-limit")
+			engine.mu.Lock()
+			close(engine.busy)
+			engine.mu.Unlock()
+			timedOut <- true
+		case <-done:
+			timedOut <- false
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		// Clients can wait for the lock again once the script is over
+		if <-timedOut {
+			engine.mu.Lock()
+			engine.busy = make(chan struct{})
+			engine.mu.Unlock()
+		}
+	}
+}
+
+// kill stops the running script or function, as long as it hasn't written anything yet
+func (engine *ScriptEngine) kill() *Value {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if engine.running == nil {
+		return &Value{typ: ERROR, err: "NOTBUSY No scripts in execution right now."}
+	}
+	if engine.running.wrote {
+		return &Value{typ: ERROR, err: "UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+	}
+
+	engine.running.killed = true
+	engine.running.cancel()
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// run runs the cached script with the given SHA1, with the given keys and args
+// available to it as the KEYS and ARGV global tables
+func (engine *ScriptEngine) run(sha string, keys, args []Value, client *Client, state *AppState) *Value {
+	script, ok := engine.scripts[sha]
+	if !ok {
+		return &Value{typ: ERROR, err: "NOSCRIPT No matching script. Please use EVAL."}
+	}
+
+	L := engine.L
+	L.SetGlobal("KEYS", valuesToLuaTable(L, keys))
+	L.SetGlobal("ARGV", valuesToLuaTable(L, args))
+
+	// Each run gets its own environment, so nothing a script does is seen by the next one
+	fn := L.NewFunctionFromProto(script.proto)
+	fn.Env = newScriptEnv(L)
+
+	ret, killed, err := engine.execute(L, fn, nil, client, state, false)
+	if killed {
+		// A killed interpreter may be left in a bad state, so start over with a new one
+		L.Close()
+		engine.L = newLuaState()
+		return &Value{typ: ERROR, err: "ERR Script killed by user with SCRIPT KILL..."}
+	}
+	if err != nil {
+		return scriptError("f_"+sha, err)
+	}
+
+	return luaToValue(L, ret)
+}
+
+// execute calls the given Lua function with the given arguments, while keeping track of it so that
+// it can be killed if it runs for too long. It returns what the function returned, or the error it raised.
+// If readOnly is set, the function isn't allowed to call commands that write to the DB
+func (engine *ScriptEngine) execute(L *lua.LState, fn *lua.LFunction, fnArgs []lua.LValue, client *Client, state *AppState, readOnly bool) (ret lua.LValue, killed bool, err error) {
+	L.SetGlobal("redis", readOnlyTable(L, engine.redisLib(L, client, state, readOnly), modifyReadOnly))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	engine.mu.Lock()
+	engine.running = &RunningScript{start: time.Now(), cancel: cancel}
+	engine.mu.Unlock()
+
+	L.SetContext(ctx)
+
+	// Every write made by the script is saved to the AOF as a single MULTI/EXEC block
+	if state.conf.aofEnabled {
+		state.aof.BeginBatch()
+		defer state.aof.EndBatch()
+	}
+
+	stopWatching := engine.watchTimeLimit(state.conf.luaTimeLimit)
+	L.Push(fn)
+	for _, arg := range fnArgs {
+		L.Push(arg)
+	}
+	err = L.PCall(len(fnArgs), 1, nil)
+	stopWatching()
+
+	L.RemoveContext()
+	engine.mu.Lock()
+	killed = engine.running.killed
+	engine.running = nil
+	engine.mu.Unlock()
+
+	if killed || err != nil {
+		return lua.LNil, killed, err
+	}
+
+	ret = L.Get(-1)
+	L.Pop(1)
+	return ret, false, nil
+}
+
+// scriptError converts an error raised while running the given script or function into an error reply.
+// Errors raised by redis.call are passed through as they are
+func scriptError(name string, err error) *Value {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+				return &Value{typ: ERROR, err: string(msg)}
+			}
+		}
+		return &Value{typ: ERROR, err: fmt.Sprintf("ERR Error running script (call to %s): %s", name, oneLine(apiErr.Object.String()))}
+	}
+	return &Value{typ: ERROR, err: fmt.Sprintf("ERR Error running script (call to %s): %s", name, oneLine(err.Error()))}
+}
+
+// oneLine replaces the newlines in an error message with spaces, since error replies can't span lines
+func oneLine(msg string) string {
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+// redisLib builds the `redis` table that scripts use to talk to the server
+func (engine *ScriptEngine) redisLib(L *lua.LState, client *Client, state *AppState, readOnly bool) *lua.LTable {
+	lib := L.NewTable()
+
+	L.SetFuncs(lib, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			reply := engine.call(L, client, state, readOnly)
+			if reply.typ == ERROR {
+				L.Error(errorTable(L, reply.err), 1)
+				return 0
+			}
+			L.Push(valueToLua(L, reply))
+			return 1
+		},
+		"pcall": func(L *lua.LState) int {
+			reply := engine.call(L, client, state, readOnly)
+			L.Push(valueToLua(L, reply))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(errorTable(L, L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			tbl := L.NewTable()
+			tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(tbl)
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			L.CheckInt(1)
+			log.Println("Script log:", L.CheckString(2))
+			return 0
+		},
+	})
+
+	setLogLevels(lib)
+
+	return lib
+}
+
+// setLogLevels adds the log levels accepted by redis.log to the given `redis` table
+func setLogLevels(lib *lua.LTable) {
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		lib.RawSetString(level, lua.LNumber(i))
+	}
+}
+
+// call runs a command on behalf of a script, via redis.call or redis.pcall.
+// The command and its arguments are the arguments passed to the Lua function
+func (engine *ScriptEngine) call(L *lua.LState, client *Client, state *AppState, readOnly bool) *Value {
+	v := Value{typ: ARRAY}
+	for i := 1; i <= L.GetTop(); i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			v.array = append(v.array, Value{typ: BULK, bulk: string(arg)})
+		case lua.LNumber:
+			v.array = append(v.array, Value{typ: BULK, bulk: arg.String()})
+		default:
+			return &Value{typ: ERROR, err: "ERR Lua redis lib command arguments must be strings or integers"}
+		}
+	}
+	if len(v.array) == 0 {
+		return &Value{typ: ERROR, err: "ERR Please specify at least one argument for this redis lib call"}
+	}
+
+	command, ok := lookupCommand(v.array[0].bulk)
+	if !ok {
+		return &Value{typ: ERROR, err: "ERR Unknown Redis command called from script"}
+	}
+	v.array[0].bulk = strings.ToUpper(command.name)
+
+	if command.hasFlag(FlagNoScript) {
+		return &Value{typ: ERROR, err: "ERR This Redis command is not allowed from script"}
+	}
+	if !command.checkArity(&v) {
+		return &Value{typ: ERROR, err: "ERR Wrong number of args calling Redis command from script"}
+	}
+
+	if command.hasFlag(FlagWrite) {
+		if readOnly {
+			return &Value{typ: ERROR, err: "ERR Write commands are not allowed from read-only scripts."}
+		}
+		engine.mu.Lock()
+		engine.running.wrote = true
+		engine.mu.Unlock()
+	}
+
+	reply := command.handler(client, &v, state)
+	DB.rememberKeys(client, command, &v)
+	return reply
+}
+
+// errorTable creates the Lua representation of an error reply: a table with a single `err` field
+func errorTable(L *lua.LState, msg string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(msg))
+	return tbl
+}
+
+// valuesToLuaTable converts a list of bulk strings into a Lua array, like KEYS and ARGV
+func valuesToLuaTable(L *lua.LState, values []Value) *lua.LTable {
+	tbl := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		tbl.Append(lua.LString(v.bulk))
+	}
+	return tbl
+}
+
+// valueToLua converts a RESP reply into a Lua value, following the same rules as Redis:
+//   - Integers become numbers
+//   - Bulk strings become strings
+//   - Nulls become false
+//   - Arrays become tables
+//   - Simple strings become a table with an `ok` field
+//   - Errors become a table with an `err` field
+func valueToLua(L *lua.LState, v *Value) lua.LValue {
+	// Scripts see replies the way a RESP2 client would
+	v = v.resp2()
+
+	switch v.typ {
+	case INTEGER:
+		return lua.LNumber(v.num)
+	case BULK:
+		return lua.LString(v.bulk)
+	case STRING:
+		tbl := L.NewTable()
+		tbl.RawSetString("ok", lua.LString(v.str))
+		return tbl
+	case ERROR:
+		return errorTable(L, v.err)
+	case ARRAY:
+		tbl := L.CreateTable(len(v.array), 0)
+		for i := range v.array {
+			tbl.Append(valueToLua(L, &v.array[i]))
+		}
+		return tbl
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToValue converts a value returned by a script into a RESP reply, following the same rules as Redis:
+//   - Numbers become integers, dropping any decimal part
+//   - Strings become bulk strings
+//   - true becomes the integer 1, while false and nil become nulls
+//   - Tables with an `ok` or `err` field become simple strings or errors
+//   - Other tables become arrays, stopping at the first nil
+func luaToValue(L *lua.LState, lv lua.LValue) *Value {
+	switch lv := lv.(type) {
+	case lua.LNumber:
+		return &Value{typ: INTEGER, num: int(lv)}
+	case lua.LString:
+		return &Value{typ: BULK, bulk: string(lv)}
+	case lua.LBool:
+		if lv {
+			return &Value{typ: INTEGER, num: 1}
+		}
+		return &Value{typ: NULL}
+	case *lua.LTable:
+		if msg, ok := lv.RawGetString("err").(lua.LString); ok {
+			return &Value{typ: ERROR, err: string(msg)}
+		}
+		if msg, ok := lv.RawGetString("ok").(lua.LString); ok {
+			return &Value{typ: STRING, str: string(msg)}
+		}
+
+		reply := Value{typ: ARRAY, array: []Value{}}
+		for i := 1; ; i++ {
+			item := lv.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			reply.array = append(reply.array, *luaToValue(L, item))
+		}
+		return &reply
+	default:
+		return &Value{typ: NULL}
+	}
+}
+
+// parseScriptArgs splits the arguments of EVAL and EVALSHA into the keys and args given to the script
+func parseScriptArgs(args []Value) (keys []Value, argv []Value, errReply *Value) {
+	numKeys, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return nil, nil, &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+	}
+	if numKeys < 0 {
+		return nil, nil, &Value{typ: ERROR, err: "ERR Number of keys can't be negative"}
+	}
+	if numKeys > len(args)-2 {
+		return nil, nil, &Value{typ: ERROR, err: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	return args[2 : 2+numKeys], args[2+numKeys:], nil
+}
+
+// eval handles the case of EVAL Redis messages
+func eval(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	keys, argv, errReply := parseScriptArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+
+	// Scripts run through EVAL are cached, so they can later be run with EVALSHA
+	sha, err := state.scripts.load(args[0].bulk)
+	if err != nil {
+		return &Value{typ: ERROR, err: "ERR Error compiling script (new function): " + oneLine(err.Error())}
+	}
+
+	return state.scripts.run(sha, keys, argv, client, state)
+}
+
+// evalsha handles the case of EVALSHA Redis messages
+func evalsha(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	keys, argv, errReply := parseScriptArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+
+	return state.scripts.run(strings.ToLower(args[0].bulk), keys, argv, client, state)
+}
+
+// script handles the case of SCRIPT Redis messages
+func script(client *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "LOAD":
+		if len(args) != 2 {
+			return wrongArgs("script|load")
+		}
+		sha, err := state.scripts.load(args[1].bulk)
+		if err != nil {
+			return &Value{typ: ERROR, err: "ERR Error compiling script (new function): " + oneLine(err.Error())}
+		}
+		return &Value{typ: BULK, bulk: sha}
+	case "EXISTS":
+		if len(args) < 2 {
+			return wrongArgs("script|exists")
+		}
+		reply := Value{typ: ARRAY}
+		for _, arg := range args[1:] {
+			_, ok := state.scripts.scripts[strings.ToLower(arg.bulk)]
+			if ok {
+				reply.array = append(reply.array, Value{typ: INTEGER, num: 1})
+			} else {
+				reply.array = append(reply.array, Value{typ: INTEGER, num: 0})
+			}
+		}
+		return &reply
+	case "FLUSH":
+		// ASYNC and SYNC are accepted for compatibility, but flushing is always synchronous
+		if len(args) > 2 || (len(args) == 2 && !contains([]string{"ASYNC", "SYNC"}, strings.ToUpper(args[1].bulk))) {
+			return &Value{typ: ERROR, err: "ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+		}
+		state.scripts.flush()
+		return &Value{typ: STRING, str: "OK"}
+	case "KILL":
+		return state.scripts.kill()
+	default:
+		return &Value{typ: ERROR, err: "ERR Unknown subcommand '" + args[0].bulk + "' for 'SCRIPT' command"}
+	}
+}
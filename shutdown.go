@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// ShutdownOptions are the SHUTDOWN modifiers. Signals shut down with none of them
+type ShutdownOptions struct {
+	nosave bool // Don't save the RDB file, even if there are save points
+	save   bool // Save the RDB file, even if there are no save points
+	now    bool // Don't wait for replicas to catch up
+	force  bool // Exit even if saving fails
+	abort  bool // Cancel a shutdown that's waiting for replicas
+}
+
+// parseShutdownOptions parses the arguments of SHUTDOWN. ABORT can't be combined with anything else
+func parseShutdownOptions(args []Value) (ShutdownOptions, error) {
+	var opts ShutdownOptions
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "NOSAVE":
+			opts.nosave = true
+		case "SAVE":
+			opts.save = true
+		case "NOW":
+			opts.now = true
+		case "FORCE":
+			opts.force = true
+		case "ABORT":
+			opts.abort = true
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+	if (opts.save && opts.nosave) || (opts.abort && len(args) > 1) {
+		return opts, errors.New("ERR syntax error")
+	}
+	return opts, nil
+}
+
+// shutdownCmd handles the case of SHUTDOWN Redis messages.
+// On success, the server exits without replying, so the client only sees the connection close
+func shutdownCmd(client *Client, v *Value, state *AppState) *Value {
+	opts, err := parseShutdownOptions(v.array[1:])
+	if err != nil {
+		return &Value{typ: ERROR, err: err.Error()}
+	}
+
+	// Shutting down never waits for replicas, since there's no replication, so there's never a shutdown to abort
+	if opts.abort {
+		return &Value{typ: ERROR, err: "ERR No shutdown in progress."}
+	}
+
+	log.Println("User requested shutdown...")
+	return shutdownReply(state.shutdown(opts))
+}
+
+// shutdownReply is the reply to a SHUTDOWN that failed, after logging why
+func shutdownReply(err error) *Value {
+	log.Println("Errors trying to shut down the server, not exiting: ", err)
+	return &Value{typ: ERROR, err: "ERR Errors trying to SHUTDOWN. Check logs."}
+}
+
+// shutdown saves the data and exits. The AOF is flushed and forced to disk, and the DB is saved to the RDB file
+// if there are save points, unless opts says otherwise. If saving fails, the server keeps running and the error is
+// returned, unless opts.force is set. Otherwise, the listeners are closed, the pidfile and Unix socket are removed,
+// and it never returns. This is the same for SHUTDOWN and signals.
+// Must be called with the command lock held, so the command that was running has finished. The only exception is
+// SHUTDOWN NOSAVE while a script is running, since the script's changes are only written to the AOF once it ends
+func (state *AppState) shutdown(opts ShutdownOptions) error {
+	if state.aof != nil {
+		log.Println("Flushing the AOF before exiting")
+		if err := state.aof.Fsync(); err != nil {
+			log.Println("Error trying to fsync the AOF: ", err)
+		}
+	}
+
+	if opts.save || (!opts.nosave && len(state.conf.rdb) > 0) {
+		log.Println("Saving the final RDB snapshot before exiting")
+		if err := SaveRDB(state); err != nil {
+			if !opts.force {
+				return fmt.Errorf("can't save the final RDB snapshot: %w", err)
+			}
+			log.Println("Can't save the final RDB snapshot, exiting anyway because of FORCE: ", err)
+		}
+	}
+
+	// Stop accepting connections. The accept loops return once their listener is closed
+	for _, l := range state.listeners {
+		l.Close()
+	}
+	if state.conf.unixsocket != "" {
+		os.Remove(state.conf.unixsocket)
+	}
+	if state.conf.pidfile != "" {
+		os.Remove(state.conf.pidfile)
+	}
+
+	log.Println("Redis is now ready to exit, bye bye...")
+	os.Exit(0)
+	return nil
+}
+
+// writePidfile writes the process ID to the pidfile, if one is set. Failing to write it is only logged, like in Redis
+func writePidfile(conf *Config) {
+	if conf.pidfile == "" {
+		return
+	}
+	if err := os.WriteFile(conf.pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		log.Println("Failed to write PID file: ", err)
+	}
+}
+
+// handleSignals shuts the server down on SIGTERM and SIGINT, once the command that's running has finished,
+// and reloads the config file on SIGHUP. A second SIGTERM or SIGINT while shutting down exits right away
+func (state *AppState) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	var shuttingDown atomic.Bool
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			state.reloadConf()
+			continue
+		}
+
+		if !shuttingDown.CompareAndSwap(false, true) {
+			log.Println("You insist... exiting now.")
+			os.Exit(1)
+		}
+		name := "SIGTERM"
+		if sig == syscall.SIGINT {
+			name = "SIGINT"
+		}
+		log.Printf("Received %s, scheduling shutdown...", name)
+
+		// Waiting for the lock could take a while if a script is running, so the next signal is still handled
+		go func() {
+			defer shuttingDown.Store(false)
+
+			state.lock(nil)
+			defer state.unlock()
+
+			if err := state.shutdown(ShutdownOptions{}); err != nil {
+				log.Println("Errors trying to shut down the server, not exiting: ", err)
+			}
+		}()
+	}
+}
+
+// reloadConf reads the config file again and applies the settings in it that changed, the same way CONFIG SET would.
+// Settings given on the command line still win over the file. Settings that can't be changed while running are
+// kept as they are, and if the file has errors or any setting can't be applied, nothing changes
+func (state *AppState) reloadConf() {
+	if state.conf.config_file == "" {
+		log.Println("Not reloading the config, the server is running without a config file")
+		return
+	}
+
+	log.Println("Reloading config file ", state.conf.config_file)
+	conf, err := readConf(state.conf.config_file, state.conf.overrides)
+	if err != nil {
+		log.Println("Can't reload the config file, keeping the current config: ", err)
+		return
+	}
+
+	state.lock(nil)
+	defer state.unlock()
+
+	var args []Value
+	var changed []string
+	state.conf.mu.RLock()
+	for _, param := range configParams {
+		value := param.get(conf)
+		if value == param.get(state.conf) {
+			continue
+		}
+		if param.immutable {
+			log.Printf("Can't change %s without a restart, keeping '%s'", param.name, param.get(state.conf))
+			continue
+		}
+		args = append(args, Value{typ: BULK, bulk: param.name}, Value{typ: BULK, bulk: value})
+		changed = append(changed, param.name)
+	}
+	state.conf.mu.RUnlock()
+
+	if len(args) == 0 {
+		log.Println("Config file reloaded, nothing changed")
+		return
+	}
+	if reply := configSet(args, state); reply.typ == ERROR {
+		log.Println("Can't reload the config file, keeping the current config: ", reply.err)
+		return
+	}
+	log.Println("Config file reloaded, changed ", strings.Join(changed, ", "))
+}
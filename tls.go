@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The TLS versions tls-protocols accepts, by the names Redis uses for them
+var tlsVersions = map[string]uint16{
+	"tlsv1":   tls.VersionTLS10,
+	"tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+// tlsParam creates a ConfigParam for a TLS setting. Changing it reloads the certificates and
+// rebuilds the TLS config, so new connections use the new settings right away.
+// validate checks the value on its own, before the TLS config is rebuilt
+func tlsParam(name string, field func(conf *Config) *string, validate func(value string) error) *ConfigParam {
+	return withApply(stringParam(name, field, validate), func(state *AppState) error {
+		if err := state.conf.loadTLS(); err != nil {
+			return fmt.Errorf("Unable to update TLS configuration: %w", err)
+		}
+		return nil
+	})
+}
+
+// validateTLSAuthClients checks a tls-auth-clients value
+func validateTLSAuthClients(value string) error {
+	if !contains([]string{"yes", "no", "optional"}, strings.ToLower(value)) {
+		return errors.New("argument must be 'yes', 'no' or 'optional'")
+	}
+	return nil
+}
+
+// parseTLSProtocols parses a list of TLS versions like "TLSv1.2 TLSv1.3", returning the lowest and highest of them.
+// An empty list means TLS 1.2 and 1.3
+func parseTLSProtocols(value string) (min, max uint16, err error) {
+	if strings.TrimSpace(value) == "" {
+		return tls.VersionTLS12, tls.VersionTLS13, nil
+	}
+
+	for _, name := range strings.Fields(value) {
+		version, ok := tlsVersions[strings.ToLower(name)]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown TLS protocol '%s'", name)
+		}
+		if min == 0 || version < min {
+			min = version
+		}
+		if version > max {
+			max = version
+		}
+	}
+	return min, max, nil
+}
+
+// validateTLSProtocols checks a tls-protocols value
+func validateTLSProtocols(value string) error {
+	_, _, err := parseTLSProtocols(value)
+	return err
+}
+
+// parseCipherSuites parses a colon separated list of cipher suite names, like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// An empty list means the defaults. TLS 1.3 suites are accepted, but they can't be turned off, so they're left out
+func parseCipherSuites(value string) ([]uint16, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	known := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(value, ":") {
+		suite, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS13) {
+			ids = append(ids, suite.ID)
+		}
+	}
+	return ids, nil
+}
+
+// validateCipherSuites checks a tls-ciphersuites value
+func validateCipherSuites(value string) error {
+	_, err := parseCipherSuites(value)
+	return err
+}
+
+// loadTLS loads the certificates and builds the TLS config from the TLS settings.
+// If TLS is off, or anything is wrong with the settings, the current TLS config is kept.
+// Must be called with conf.mu held, unless no connections are accepted yet
+func (conf *Config) loadTLS() error {
+	if conf.tlsPort == 0 {
+		return nil
+	}
+
+	if conf.tlsCertFile == "" || conf.tlsKeyFile == "" {
+		return errors.New("tls-cert-file and tls-key-file must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.tlsCertFile, conf.tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("can't load the certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if conf.tlsCACertFile != "" {
+		pem, err := os.ReadFile(conf.tlsCACertFile)
+		if err != nil {
+			return fmt.Errorf("can't read the CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in tls-ca-cert-file")
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	// Clients must send a certificate signed by the CA by default
+	switch strings.ToLower(conf.tlsAuthClients) {
+	case "no":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if tlsConfig.ClientAuth != tls.NoClientCert && tlsConfig.ClientCAs == nil {
+		return errors.New("tls-ca-cert-file must be set to authenticate clients")
+	}
+
+	if tlsConfig.MinVersion, tlsConfig.MaxVersion, err = parseTLSProtocols(conf.tlsProtocols); err != nil {
+		return err
+	}
+	if tlsConfig.CipherSuites, err = parseCipherSuites(conf.tlsCiphersuites); err != nil {
+		return err
+	}
+
+	conf.tlsConfig = tlsConfig
+	return nil
+}
+
+// currentTLSConfig gives each new TLS connection the latest TLS config, so reloaded certificates are used right away
+func (conf *Config) currentTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	return conf.tlsConfig, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA along with certificates signed by it, written to a temporary directory
+type testPKI struct {
+	dir    string
+	caKey  *ecdsa.PrivateKey
+	ca     *x509.Certificate
+	caFile string
+	pool   *x509.CertPool
+	serial int64
+}
+
+// newTestPKI creates a self-signed CA
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	pki := &testPKI{dir: t.TempDir(), pool: x509.NewCertPool()}
+	pki.caKey = newTestKey(t)
+	template := pki.template("Test CA")
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &pki.caKey.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pki.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	pki.pool.AddCert(pki.ca)
+	pki.caFile = pki.write(t, "ca.crt", "CERTIFICATE", der)
+	return pki
+}
+
+// newTestKey generates a P-256 key
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// template returns a certificate template valid for an hour, with a new serial number
+func (pki *testPKI) template(name string) *x509.Certificate {
+	pki.serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(pki.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+// write saves a PEM block to the PKI's directory and returns its path
+func (pki *testPKI) write(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(pki.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue creates a certificate signed by the CA, for either a server on localhost or a client.
+// It returns the paths of the certificate and key files
+func (pki *testPKI) issue(t *testing.T, name string, server bool) (certFile, keyFile string) {
+	t.Helper()
+
+	key := newTestKey(t)
+	template := pki.template(name)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.ca, &key.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pki.write(t, name+".crt", "CERTIFICATE", der), pki.write(t, name+".key", "PRIVATE KEY", keyDER)
+}
+
+// clientConfig returns the TLS config of a client that trusts the CA, sending the given certificate if there is one
+func (pki *testPKI) clientConfig(t *testing.T, certFile, keyFile string) *tls.Config {
+	t.Helper()
+
+	conf := &tls.Config{RootCAs: pki.pool, ServerName: "localhost"}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf
+}
+
+// newTLSTestState creates an AppState with TLS set up with a server certificate signed by the CA,
+// along with a listener that serves TLS the same way the server's TLS listeners do
+func newTLSTestState(t *testing.T, pki *testPKI) (*AppState, net.Listener) {
+	t.Helper()
+
+	state := newTestState(t, false)
+	state.conf.tlsPort = 6380 // Only turns TLS on, the test listener uses any free port
+	state.conf.tlsCertFile, state.conf.tlsKeyFile = pki.issue(t, "server", true)
+	state.conf.tlsCACertFile = pki.caFile
+	if err := state.conf.loadTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return state, tls.NewListener(l, &tls.Config{GetConfigForClient: state.conf.currentTLSConfig})
+}
+
+// handshake connects to the listener with the given client config, and returns the certificate the server sent.
+// The error is the server's, since with TLS 1.3 the client is done with the handshake before the server
+// checks its certificate
+func handshake(t *testing.T, l net.Listener, conf *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	var cert *x509.Certificate
+	conn, err := tls.Dial("tcp", l.Addr().String(), conf)
+	if err == nil {
+		cert = conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+	}
+	return cert, <-serverErr
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	_, l := newTLSTestState(t, pki)
+
+	certFile, keyFile := pki.issue(t, "client", false)
+	cert, err := handshake(t, l, pki.clientConfig(t, certFile, keyFile))
+	if err != nil {
+		t.Fatalf("handshake with a client certificate failed: %v", err)
+	}
+	if cert.Subject.CommonName != "server" {
+		t.Fatalf("server sent the certificate of %q, want %q", cert.Subject.CommonName, "server")
+	}
+}
+
+func TestTLSRejectsClientWithoutCert(t *testing.T) {
+	pki := newTestPKI(t)
+	state, l := newTLSTestState(t, pki)
+	if state.conf.tlsAuthClients != "yes" {
+		t.Fatalf("tls-auth-clients is %q, want yes", state.conf.tlsAuthClients)
+	}
+
+	if _, err := handshake(t, l, pki.clientConfig(t, "", "")); err == nil {
+		t.Fatal("handshake without a client certificate succeeded")
+	}
+
+	// A certificate from another CA is no better
+	other := newTestPKI(t)
+	certFile, keyFile := other.issue(t, "client", false)
+	conf := other.clientConfig(t, certFile, keyFile)
+	conf.RootCAs = pki.pool
+	if _, err := handshake(t, l, conf); err == nil {
+		t.Fatal("handshake with a certificate signed by another CA succeeded")
+	}
+}
+
+func TestTLSProtocols(t *testing.T) {
+	pki := newTestPKI(t)
+	state, l := newTLSTestState(t, pki)
+	certFile, keyFile := pki.issue(t, "client", false)
+
+	if reply := configSet(cmdValue("tls-protocols", "TLSv1.3").array, state); reply.typ == ERROR {
+		t.Fatalf("CONFIG SET tls-protocols failed: %s", reply.err)
+	}
+
+	tls12 := pki.clientConfig(t, certFile, keyFile)
+	tls12.MaxVersion = tls.VersionTLS12
+	if _, err := handshake(t, l, tls12); err == nil {
+		t.Fatal("TLS 1.2 handshake succeeded with tls-protocols TLSv1.3")
+	}
+
+	tls13 := pki.clientConfig(t, certFile, keyFile)
+	tls13.MinVersion = tls.VersionTLS13
+	if _, err := handshake(t, l, tls13); err != nil {
+		t.Fatalf("TLS 1.3 handshake failed with tls-protocols TLSv1.3: %v", err)
+	}
+}
+
+func TestTLSConfigSetCert(t *testing.T) {
+	pki := newTestPKI(t)
+	state, l := newTLSTestState(t, pki)
+	clientCert, clientKey := pki.issue(t, "client", false)
+	conf := pki.clientConfig(t, clientCert, clientKey)
+
+	certFile, keyFile := pki.issue(t, "server2", true)
+	if reply := configSet(cmdValue("tls-cert-file", certFile, "tls-key-file", keyFile).array, state); reply.typ == ERROR {
+		t.Fatalf("CONFIG SET tls-cert-file tls-key-file failed: %s", reply.err)
+	}
+
+	cert, err := handshake(t, l, conf)
+	if err != nil {
+		t.Fatalf("handshake after switching certificates failed: %v", err)
+	}
+	if cert.Subject.CommonName != "server2" {
+		t.Fatalf("server sent the certificate of %q, want %q", cert.Subject.CommonName, "server2")
+	}
+
+	// A key that doesn't match the certificate is refused, and the last certificate is kept
+	_, otherKey := pki.issue(t, "server3", true)
+	if reply := configSet(cmdValue("tls-key-file", otherKey).array, state); reply.typ != ERROR {
+		t.Fatal("CONFIG SET tls-key-file with the wrong key succeeded")
+	}
+	if state.conf.tlsKeyFile != keyFile {
+		t.Fatalf("tls-key-file is %q after a failed CONFIG SET, want %q", state.conf.tlsKeyFile, keyFile)
+	}
+	if cert, err := handshake(t, l, conf); err != nil || cert.Subject.CommonName != "server2" {
+		t.Fatalf("handshake after a failed CONFIG SET gave %v, %v", cert, err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The channel RESP2 clients subscribe to, to get the invalidations of the clients that redirect them to it
+const invalidationChannel = "__redis__:invalidate"
+
+// Tracking is the client-side caching state of a client, set by CLIENT TRACKING.
+// The client is sent an invalidation message whenever a key it may have cached changes
+type Tracking struct {
+	redirect int64    // The ID of the client that gets the invalidations instead, 0 if there's none
+	bcast    bool     // Whether the client hears about every key that changes, instead of only the keys it read
+	prefixes []string // In BCAST mode, only keys with one of these prefixes are tracked. None means every key
+	optIn    bool     // Only keys read right after CLIENT CACHING yes are tracked
+	optOut   bool     // Keys read right after CLIENT CACHING no aren't tracked
+	noLoop   bool     // The client isn't told about keys it changes itself
+	caching  bool     // Set by CLIENT CACHING, for the next command only
+}
+
+// isTracked checks whether any client needs to hear about changes to the given key
+func (db *Database) isTracked(key string) bool {
+	if len(db.trackedKeys[key]) > 0 {
+		return true
+	}
+	for prefix := range db.bcastPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberKeys remembers that the client read the keys of a read-only command, so it's told once they change.
+// Must be called with the command lock held, after running the command
+func (db *Database) rememberKeys(client *Client, command *Command, v *Value) {
+	tracking := client.tracking
+	if tracking == nil || tracking.bcast || !command.hasFlag(FlagReadOnly) {
+		return
+	}
+	if (tracking.optIn && !tracking.caching) || (tracking.optOut && tracking.caching) {
+		return
+	}
+
+	positions, ok := command.keyPositions(v.array)
+	if !ok {
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, i := range positions {
+		key := v.array[i].bulk
+		if db.trackedKeys[key] == nil {
+			db.trackedKeys[key] = map[int64]bool{}
+		}
+		db.trackedKeys[key][client.id] = true
+	}
+}
+
+// disableTracking turns off client-side caching for the client. Must be called with the command lock held
+func (db *Database) disableTracking(client *Client) {
+	if client.tracking == nil {
+		return
+	}
+
+	db.mu.Lock()
+	for _, prefix := range client.tracking.prefixes {
+		delete(db.bcastPrefixes[prefix], client.id)
+		if len(db.bcastPrefixes[prefix]) == 0 {
+			delete(db.bcastPrefixes, prefix)
+		}
+	}
+	db.mu.Unlock()
+
+	// Keys the client read are forgotten lazily, once they change
+	client.tracking = nil
+}
+
+// sendInvalidations tells tracking clients about the keys they track that were modified, expired or evicted.
+// In the default mode, a key is only tracked until the next time it changes, since the client has to read it again to cache it.
+// Called after every command, like serveBlockedClients. Must be called with the command lock held
+func sendInvalidations(state *AppState, current *Client) {
+	DB.mu.Lock()
+	keys, all := DB.invalidKeys, DB.invalidAll
+	DB.invalidKeys, DB.invalidAll = nil, false
+
+	// Keys of each client to invalidate, by ID. Flushing the DB invalidates every key, which is sent as a null
+	invalid := map[int64][]string{}
+	if all {
+		for _, ids := range DB.trackedKeys {
+			for id := range ids {
+				invalid[id] = nil
+			}
+		}
+		for _, ids := range DB.bcastPrefixes {
+			for id := range ids {
+				invalid[id] = nil
+			}
+		}
+		DB.trackedKeys = map[string]map[int64]bool{}
+	}
+	for _, key := range keys {
+		for id := range DB.trackedKeys[key] {
+			invalid[id] = append(invalid[id], key)
+		}
+		delete(DB.trackedKeys, key)
+
+		for prefix, ids := range DB.bcastPrefixes {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for id := range ids {
+				if !slices.Contains(invalid[id], key) {
+					invalid[id] = append(invalid[id], key)
+				}
+			}
+		}
+	}
+	DB.mu.Unlock()
+
+	for id, keys := range invalid {
+		state.clientsMu.Lock()
+		client, ok := state.clients[id]
+		state.clientsMu.Unlock()
+
+		// The client may have gone, or stopped tracking since it read the keys
+		if !ok || client.tracking == nil || (client.tracking.noLoop && client == current) {
+			continue
+		}
+		if all {
+			keys = nil
+		}
+		client.sendInvalidation(keys, state)
+	}
+}
+
+// sendInvalidation sends an invalidation message for the given keys, or for every key if there are none.
+// RESP3 clients get it as a push message. RESP2 clients can only get it through a redirect to a client
+// subscribed to __redis__:invalidate, which gets it as a pub/sub message
+func (client *Client) sendInvalidation(keys []string, state *AppState) {
+	msg := Value{typ: NULL}
+	if keys != nil {
+		msg = *bulkArray(keys)
+	}
+
+	target := client
+	if redirect := client.tracking.redirect; redirect != 0 {
+		state.clientsMu.Lock()
+		var ok bool
+		target, ok = state.clients[redirect]
+		state.clientsMu.Unlock()
+
+		// Let the client know its invalidations are being lost, if it can be told
+		if !ok {
+			if client.proto == 3 {
+				client.push(&Value{typ: PUSH, array: []Value{
+					{typ: BULK, bulk: "tracking-redir-broken"},
+					{typ: INTEGER, num: int(redirect)},
+				}}, state)
+			}
+			return
+		}
+	}
+
+	switch {
+	case target.proto == 3:
+		target.push(&Value{typ: PUSH, array: []Value{{typ: BULK, bulk: "invalidate"}, msg}}, state)
+	case target != client && slices.Contains(target.subscriptions, invalidationChannel):
+		target.push(&Value{typ: PUSH, array: []Value{
+			{typ: BULK, bulk: "message"},
+			{typ: BULK, bulk: invalidationChannel},
+			msg,
+		}}, state)
+	}
+}
+
+// clientTracking handles CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix [PREFIX prefix...]] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func clientTracking(client *Client, args []Value, state *AppState) *Value {
+	if len(args) < 1 {
+		return wrongArgs("client|tracking")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "ON":
+	case "OFF":
+		DB.disableTracking(client)
+		return &Value{typ: STRING, str: "OK"}
+	default:
+		return &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	tracking := &Tracking{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			id, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return &Value{typ: ERROR, err: "ERR value is not an integer or out of range"}
+			}
+			state.clientsMu.Lock()
+			_, ok := state.clients[id]
+			state.clientsMu.Unlock()
+			if !ok {
+				return &Value{typ: ERROR, err: "ERR The client ID you want redirect to does not exist"}
+			}
+			tracking.redirect = id
+			i++
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return &Value{typ: ERROR, err: "ERR syntax error"}
+			}
+			tracking.prefixes = append(tracking.prefixes, args[i+1].bulk)
+			i++
+		case "BCAST":
+			tracking.bcast = true
+		case "OPTIN":
+			tracking.optIn = true
+		case "OPTOUT":
+			tracking.optOut = true
+		case "NOLOOP":
+			tracking.noLoop = true
+		default:
+			return &Value{typ: ERROR, err: "ERR syntax error"}
+		}
+	}
+
+	switch {
+	case len(tracking.prefixes) > 0 && !tracking.bcast:
+		return &Value{typ: ERROR, err: "ERR PREFIX option requires BCAST mode to be enabled"}
+	case tracking.optIn && tracking.optOut:
+		return &Value{typ: ERROR, err: "ERR You can't use both OPTIN and OPTOUT"}
+	case (tracking.optIn || tracking.optOut) && tracking.bcast:
+		return &Value{typ: ERROR, err: "ERR OPTIN and OPTOUT are not compatible with BCAST"}
+	case client.tracking != nil && client.tracking.bcast != tracking.bcast:
+		return &Value{typ: ERROR, err: "ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."}
+	}
+
+	// Turning tracking on again replaces the previous options
+	DB.disableTracking(client)
+	client.tracking = tracking
+
+	// Without prefixes, BCAST tracks every key, which is every key with an empty prefix
+	if tracking.bcast {
+		if len(tracking.prefixes) == 0 {
+			tracking.prefixes = []string{""}
+		}
+		DB.mu.Lock()
+		for _, prefix := range tracking.prefixes {
+			if DB.bcastPrefixes[prefix] == nil {
+				DB.bcastPrefixes[prefix] = map[int64]bool{}
+			}
+			DB.bcastPrefixes[prefix][client.id] = true
+		}
+		DB.mu.Unlock()
+	}
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// clientCaching handles CLIENT CACHING YES|NO, which decides whether the keys read by the next command are tracked
+func clientCaching(client *Client, args []Value) *Value {
+	if len(args) != 1 {
+		return wrongArgs("client|caching")
+	}
+
+	tracking := client.tracking
+	if tracking == nil || !(tracking.optIn || tracking.optOut) {
+		return &Value{typ: ERROR, err: "ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "YES":
+		if !tracking.optIn {
+			return &Value{typ: ERROR, err: "ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."}
+		}
+	case "NO":
+		if !tracking.optOut {
+			return &Value{typ: ERROR, err: "ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."}
+		}
+	default:
+		return &Value{typ: ERROR, err: "ERR syntax error"}
+	}
+
+	tracking.caching = true
+	return &Value{typ: STRING, str: "OK"}
+}
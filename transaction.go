@@ -1,8 +1,11 @@
 package main
 
+import "slices"
+
 // A Transaction is made of multiple commands
 type Transaction struct {
 	commands []*TxCommand
+	failed   bool // Whether a command was rejected while queueing, making EXEC fail
 }
 
 // NewTransaction creates a new Transaction type to group
@@ -15,5 +18,90 @@ func NewTransaction() *Transaction {
 // TxCommand is a command to be executed in a transaction
 type TxCommand struct {
 	v       *Value
-	handler Handler
+	command *Command
+}
+
+// hasFlag checks whether any of the queued commands has the given flag
+func (transaction *Transaction) hasFlag(flag string) bool {
+	for _, cmd := range transaction.commands {
+		if cmd.command.hasFlag(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagTransaction marks the client's transaction (if any) as failed,
+// because one of the commands sent to be queued was rejected
+func (client *Client) flagTransaction() {
+	if client.transaction != nil {
+		client.transaction.failed = true
+	}
+}
+
+// watch marks the given key as watched by the given client. If any other client
+// modifies the key before the watching client calls EXEC, the transaction is aborted.
+// Used to implement the WATCH command
+func (db *Database) watch(client *Client, key string) {
+	// Watching the same key twice is a no-op
+	if slices.Contains(client.watchedKeys, key) {
+		return
+	}
+
+	db.watchers[key] = append(db.watchers[key], client)
+	client.watchedKeys = append(client.watchedKeys, key)
+}
+
+// unwatch removes all the keys the given client is watching and resets its dirty flag.
+// Used to implement the UNWATCH command, and called whenever EXEC or DISCARD end a transaction
+func (db *Database) unwatch(client *Client) {
+	for _, key := range client.watchedKeys {
+		clients := slices.DeleteFunc(db.watchers[key], func(c *Client) bool {
+			return c == client
+		})
+
+		if len(clients) == 0 {
+			delete(db.watchers, key)
+		} else {
+			db.watchers[key] = clients
+		}
+	}
+
+	client.watchedKeys = nil
+	client.dirty = false
+}
+
+// touch flags every client watching the given key as dirty, so their next EXEC fails,
+// and remembers to tell the clients tracking it that it changed.
+// Must be called with the DB lock held, whenever a key is modified, expired or evicted
+func (db *Database) touch(key string) {
+	for _, client := range db.watchers[key] {
+		client.dirty = true
+	}
+	if db.isTracked(key) && !slices.Contains(db.invalidKeys, key) {
+		db.invalidKeys = append(db.invalidKeys, key)
+	}
+}
+
+// touchAll flags every client watching a key that currently exists as dirty.
+// Used when the whole DB is modified at once, like with FLUSHDB
+func (db *Database) touchAll() {
+	db.invalidAll = true
+	for key := range db.watchers {
+		if _, ok := db.store[key]; ok {
+			db.touch(key)
+		}
+	}
+}
+
+// watchedKeyExpired checks if any of the keys the client is watching have expired,
+// even if they haven't been lazily deleted yet. An expired key counts as a modified one
+func (db *Database) watchedKeyExpired(client *Client) bool {
+	for _, key := range client.watchedKeys {
+		item, ok := db.store[key]
+		if ok && item.shouldExpire() {
+			return true
+		}
+	}
+	return false
 }
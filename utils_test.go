@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// repr must only give printable ASCII, and read back as the same bytes when parsed like a redis-cli argument
+func TestReprRandomBinary(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for range 1000 {
+		s := randomBytes(r, 64)
+		quoted := repr(s)
+
+		for i := 0; i < len(quoted); i++ {
+			if quoted[i] < ' ' || quoted[i] > '~' {
+				t.Fatalf("repr(%q) = %q has the unprintable byte %#x", s, quoted, quoted[i])
+			}
+		}
+
+		args, err := splitArgs(quoted)
+		if err != nil {
+			t.Fatalf("can't parse repr(%q) = %q: %v", s, quoted, err)
+		}
+		if len(args) != 1 || args[0] != s {
+			t.Fatalf("repr(%q) = %q parsed back as %q", s, quoted, args)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -20,57 +19,158 @@ const (
 	ERROR   ValueType = "-"
 	NULL    ValueType = ""
 	INTEGER ValueType = ":"
+
+	// A null array, which RESP2 sends as *-1 instead of the null bulk string sent for NULL
+	NULLARRAY ValueType = "*-1"
+
+	// RESP3 types. Clients that haven't switched to RESP3 with HELLO get them as the closest RESP2 type
+	MAP       ValueType = "%"
+	SET       ValueType = "~"
+	DOUBLE    ValueType = ","
+	BOOLEAN   ValueType = "#"
+	BIGNUMBER ValueType = "("
+	VERBATIM  ValueType = "="
+	ATTRIBUTE ValueType = "|"
+	PUSH      ValueType = ">"
 )
 
 // Define a RESP message type
 type Value struct {
-	typ   ValueType
-	bulk  string
-	str   string
-	err   string
-	num   int
-	array []Value
+	typ     ValueType
+	bulk    string // Also holds the text of VERBATIM strings
+	str     string // Also holds the digits of BIGNUMBERs
+	err     string
+	num     int
+	dbl     float64
+	boolean bool
+	format  string  // The 3 character format of VERBATIM strings, like "txt"
+	array   []Value // MAPs hold their keys and values one after the other
+	attrs   []Value // Attributes sent before the value in RESP3, as keys and values one after the other
+}
+
+// argsRepr quotes every element of an array with repr, separated by spaces, for MONITOR and logs
+func (v *Value) argsRepr() string {
+	args := make([]string, len(v.array))
+	for i := range v.array {
+		args[i] = repr(v.array[i].bulk)
+	}
+	return strings.Join(args, " ")
+}
+
+// resp2 converts RESP3 types to the RESP2 types clients that haven't switched with HELLO understand:
+//   - MAPs, SETs and PUSH messages become ARRAYs, with a map's keys and values one after the other
+//   - DOUBLEs, BIGNUMBERs and VERBATIM strings become bulk strings
+//   - BOOLEANs become the integers 1 and 0
+//   - Attributes are dropped
+func (v *Value) resp2() *Value {
+	switch v.typ {
+	case MAP, SET, PUSH, ARRAY:
+		arr := make([]Value, len(v.array))
+		for i := range v.array {
+			arr[i] = *v.array[i].resp2()
+		}
+		return &Value{typ: ARRAY, array: arr}
+	case DOUBLE:
+		return &Value{typ: BULK, bulk: formatDouble(v.dbl)}
+	case BIGNUMBER:
+		return &Value{typ: BULK, bulk: v.str}
+	case VERBATIM:
+		return &Value{typ: BULK, bulk: v.bulk}
+	case BOOLEAN:
+		if v.boolean {
+			return &Value{typ: INTEGER, num: 1}
+		}
+		return &Value{typ: INTEGER, num: 0}
+	default:
+		if v.attrs == nil {
+			return v
+		}
+		plain := *v
+		plain.attrs = nil
+		return &plain
+	}
+}
+
+// The longest line a client can send, which limits the size of inline commands
+const maxInlineLen = 64 * 1024
+
+var errLineTooLong = errors.New("line too long")
+
+// A ProtocolError is sent back to a client that sent something that isn't valid RESP, before closing its connection
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
 }
 
-// readLine reads a line from the user and trims the \r\n characters
+// readLine reads a line from the user and trims the \r\n characters.
+// Lines longer than maxInlineLen are rejected, so a client can't make the server buffer endless data
 func readLine(reader *bufio.Reader) (string, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineLen {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
 	}
-	return strings.TrimSuffix(line, "\r\n"), nil
+
+	// Inline commands may end with just \n
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
 }
 
+// The most elements a client can send in a single command
+const maxMultibulkLen = 1024 * 1024
+
 // readArray reads an array RESP message from the given io.Reader into the Value type.
 // It first reads the length of the array, then reads that many bulk strings from the reader.
-// The bulk strings are added to the Value's array field
-func (v *Value) readArray(reader *bufio.Reader) error {
+// The bulk strings are added to the Value's array field.
+// Lines that don't start with * are read as inline commands, like the ones typed into telnet.
+// Bulk strings longer than maxBulkLen are rejected, unless it's 0.
+// Malformed messages give a ProtocolError
+func (v *Value) readArray(reader *bufio.Reader, maxBulkLen int64) error {
 
 	// Get the line from the user
 	line, err := readLine(reader)
+	if err == errLineTooLong {
+		return &ProtocolError{"too big inline request"}
+	}
 	if err != nil {
 		return err
 	}
 
-	// If the line doesn't begin with *, then it's not an ARRAY type
-	if line[0] != '*' {
-		return errors.New("expected array")
+	// If the line doesn't begin with *, then it's not an ARRAY type, so it's an inline command
+	if len(line) == 0 || line[0] != '*' {
+		return v.readInline(line)
 	}
 
 	// Since arrays have a length associated with it, read that length
-	arrLen, err := strconv.Atoi(line[1:])
-	if err != nil {
-		fmt.Println(err)
-		return err
+	arrLen, ok := parseLength(line[1:])
+	if !ok || arrLen > maxMultibulkLen {
+		return &ProtocolError{"invalid multibulk length"}
+	}
+
+	// Null and empty arrays have nothing to run, so they're ignored like empty inline commands
+	if arrLen <= 0 {
+		return nil
 	}
 
 	// Once we know how many bulk strings are in the message,
 	// read those and add them to the array
+	v.array = make([]Value, 0, min(arrLen, 1024))
 	for range arrLen {
-		bulk, err := v.readBulk(reader)
+		bulk, err := v.readBulk(reader, maxBulkLen)
 		if err != nil {
-			log.Println(err)
-			break
+			return err
 		}
 		v.array = append(v.array, bulk)
 	}
@@ -78,31 +178,193 @@ func (v *Value) readArray(reader *bufio.Reader) error {
 	return nil
 }
 
+// parseLength parses the length of an array or bulk string. Only digits are allowed, with an optional leading minus
+func parseLength(s string) (int64, bool) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || len(digits) > 18 {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// readInline splits an inline command into its arguments, adding them to the Value's array field as bulk strings.
+// Empty lines give an empty array, which is ignored
+func (v *Value) readInline(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: BULK, bulk: arg})
+	}
+	return nil
+}
+
+// splitArgs splits a line into arguments with the same rules as redis-cli:
+//   - Arguments are separated by spaces
+//   - Double quoted arguments can contain spaces and the escapes \n, \r, \t, \b, \a, \\, \" and \xHH
+//   - Single quoted arguments can contain spaces, and \' is the only escape
+//   - A closing quote must be followed by a space or the end of the line
+func splitArgs(line string) ([]string, error) {
+	unbalanced := &ProtocolError{"unbalanced quotes in request"}
+	args := []string{}
+
+	i := 0
+	for {
+		// Skip the spaces before the next argument
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			switch {
+			case inDouble:
+				if i == len(line) {
+					return nil, unbalanced
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case c == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, unbalanced
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if i == len(line) {
+					return nil, unbalanced
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, unbalanced
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch c := line[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(arg))
+	}
+}
+
+// isSpace checks whether a byte separates inline arguments
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+// isHexDigit checks whether a byte is a hexadecimal digit
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 // readBulk reads a bulk RESP message from the given io.Reader into the Value type.
 // It first reads the size of the bulk string, then reads that many bytes from the reader.
-// The bulk string is returned as a Value with the BULK type
-func (v *Value) readBulk(reader *bufio.Reader) (Value, error) {
+// The bulk string is returned as a Value with the BULK type, or NULL for a null bulk string
+func (v *Value) readBulk(reader *bufio.Reader, maxBulkLen int64) (Value, error) {
 	line, err := readLine(reader)
+	if err == errLineTooLong {
+		return Value{}, &ProtocolError{"too big bulk count string"}
+	}
 	if err != nil {
 		return Value{}, err
 	}
 
-	// Get size of string in BULK buffer
-	n, err := strconv.Atoi(line[1:])
-	if err != nil {
-		return Value{}, err
+	if len(line) == 0 || line[0] != '$' {
+		got := "end of line"
+		if len(line) > 0 {
+			got = "'" + line[:1] + "'"
+		}
+		return Value{}, &ProtocolError{"expected '$', got " + got}
 	}
 
-	// Create buffer for the bulk string, including \r\n
-	bulkBuffer := make([]byte, n+2)
+	// Get size of string in BULK buffer
+	n, ok := parseLength(line[1:])
+	if !ok || n < -1 || (maxBulkLen > 0 && n > maxBulkLen) {
+		return Value{}, &ProtocolError{"invalid bulk length"}
+	}
+	if n == -1 {
+		return Value{typ: NULL}, nil
+	}
 
-	// Read all of the reader into the bulkBuffer
-	if _, err := io.ReadFull(reader, bulkBuffer); err != nil {
+	// Read the bulk string, including \r\n. The buffer grows as data actually arrives,
+	// so a client can't make the server allocate a huge buffer just by sending a huge length
+	var bulkBuffer bytes.Buffer
+	bulkBuffer.Grow(int(min(n+2, 64*1024)))
+	if _, err := io.CopyN(&bulkBuffer, reader, n+2); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return Value{}, err
 	}
 
+	data := bulkBuffer.Bytes()
+	if data[n] != '\r' || data[n+1] != '\n' {
+		return Value{}, &ProtocolError{"expected CRLF after bulk string"}
+	}
+
 	// The actual bulk string doesn't include \r\n
-	bulk := string(bulkBuffer[:n])
+	bulk := string(data[:n])
 
 	return Value{typ: BULK, bulk: bulk}, nil
 }
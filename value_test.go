@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// FuzzReadArray feeds arbitrary bytes to the RESP reader. Whatever it's given, it must not panic, and anything
+// it accepts must read back the same once written out again as RESP. Inline commands go through splitArgs,
+// whose arguments must also split the same once quoted again
+func FuzzReadArray(f *testing.F) {
+	seeds := []string{
+		"*1\r\n$4\r\nPING\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n",
+		"*2\r\n$3\r\nGET\r\n$-1\r\n",
+		"*0\r\n",
+		"*-1\r\n",
+		"*2\r\n$3\r\nSET\r\n",
+		"*1\r\n$10\r\nshort\r\n",
+		"*1\r\n$3\r\nabcde\r\n",
+		"*1\r\n:5\r\n",
+		"*99999999999999999999\r\n",
+		"*1\r\n$-2\r\n",
+		"*1\r\n$3\r\na\x00b\r\n",
+		"PING\r\n",
+		"SET k \"hello world\"\n",
+		"SET k \"\\x41\\n\" 'it\\'s'\r\n",
+		"SET k \"unbalanced\r\n",
+		"SET k \"a\"b\r\n",
+		"\r\n",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for range 16 {
+			v := Value{typ: ARRAY}
+			err := v.readArray(reader, 1024)
+			var protoErr *ProtocolError
+			if errors.As(err, &protoErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			checkRoundTrip(t, &v)
+		}
+	})
+}
+
+// checkRoundTrip writes a command out as RESP and checks it reads back the same
+func checkRoundTrip(t *testing.T, v *Value) {
+	t.Helper()
+	if len(v.array) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write(v)
+	w.Flush()
+
+	again := Value{typ: ARRAY}
+	if err := again.readArray(bufio.NewReader(&buf), 0); err != nil {
+		t.Fatalf("can't read back %q: %v", buf.String(), err)
+	}
+	if len(again.array) != len(v.array) {
+		t.Fatalf("read back %d arguments, want %d", len(again.array), len(v.array))
+	}
+	for i := range v.array {
+		if again.array[i].typ != v.array[i].typ || again.array[i].bulk != v.array[i].bulk {
+			t.Fatalf("argument %d read back as %q, want %q", i, again.array[i].bulk, v.array[i].bulk)
+		}
+	}
+}
+
+// quoteArg double quotes an argument, escaping it so splitArgs reads it back as is
+func quoteArg(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// FuzzSplitArgs checks that splitArgs never panics, and that the arguments it gives split the same once quoted again
+func FuzzSplitArgs(f *testing.F) {
+	for _, seed := range []string{
+		`SET k v`,
+		`SET k "hello world"`,
+		`"\x00\xff\n\r\t\b\a\\\""`,
+		`'it\'s' "quoted"`,
+		`"unbalanced`,
+		`"a"b`,
+		`""`,
+		" \t\v\f ",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		args, err := splitArgs(line)
+		if err != nil {
+			return
+		}
+
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = quoteArg(arg)
+		}
+		again, err := splitArgs(strings.Join(quoted, " "))
+		if err != nil {
+			t.Fatalf("can't split %q again: %v", quoted, err)
+		}
+		if !slices.Equal(again, args) {
+			t.Fatalf("split %q again as %q, want %q", quoted, again, args)
+		}
+	})
+}
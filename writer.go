@@ -1,58 +1,254 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
 	"io"
 	"log"
+	"math"
+	"strconv"
+	"sync"
 )
 
+// Buffers bigger than this aren't kept around for the next replies once they're sent
+const maxSpareBuffer = 64 * 1024
+
 type Writer struct {
-	writer io.Writer
+	writer  io.Writer
+	proto   int        // The RESP version to write, either 2 or 3
+	mu      sync.Mutex // Replies can be written from other goroutines, like MONITOR logs. Never held while sending
+	buf     []byte     // Replies waiting to be sent
+	spare   []byte     // An empty buffer to write the next replies to, while buf is being sent
+	sending int        // How many bytes are being sent right now
+
+	flushMu       sync.Mutex // Held while sending, so replies are sent in order
+	flushRequests chan struct{}
 }
 
-// NewWriter creates a new Writer from a given io.Writer.
+// NewWriter creates a new Writer from a given io.Writer. It writes RESP2 unless told otherwise
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: bufio.NewWriter(w)}
+	return &Writer{writer: w, proto: 2, flushRequests: make(chan struct{}, 1)}
+}
+
+// SetProto switches the RESP version the Writer writes
+func (w *Writer) SetProto(proto int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.proto = proto
 }
 
-func (w *Writer) Deserialize(v *Value) (reply string) {
+// appendValue serializes a Value as RESP, appending it to the given bytes.
+// Writers for RESP2 write RESP3 types as the closest RESP2 type, the same way as Value.resp2
+func (w *Writer) appendValue(b []byte, v *Value) []byte {
+	resp2 := w.proto < 3
+
+	// Attributes come right before the value they describe
+	if len(v.attrs) > 0 && !resp2 {
+		b = appendHeader(b, ATTRIBUTE, len(v.attrs)/2)
+		for i := range v.attrs {
+			b = w.appendValue(b, &v.attrs[i])
+		}
+	}
+
 	switch v.typ {
 	case ARRAY:
-		// Specify length of array
-		reply = fmt.Sprintf("*%d\r\n", len(v.array))
-
-		// For each item in the array, deserialize it
-		for _, sub := range v.array {
-			reply += w.Deserialize(&sub)
+		// Specify length of array, then serialize each item in it
+		b = appendHeader(b, ARRAY, len(v.array))
+		for i := range v.array {
+			b = w.appendValue(b, &v.array[i])
+		}
+	case SET, PUSH:
+		typ := v.typ
+		if resp2 {
+			typ = ARRAY
+		}
+		b = appendHeader(b, typ, len(v.array))
+		for i := range v.array {
+			b = w.appendValue(b, &v.array[i])
+		}
+	case MAP:
+		// Maps are sized by their number of key-value pairs, while RESP2 arrays count keys and values
+		if resp2 {
+			b = appendHeader(b, ARRAY, len(v.array))
+		} else {
+			b = appendHeader(b, MAP, len(v.array)/2)
+		}
+		for i := range v.array {
+			b = w.appendValue(b, &v.array[i])
 		}
 	case STRING:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+		b = append(b, STRING...)
+		b = appendLine(b, v.str)
+		b = append(b, "\r\n"...)
 	case INTEGER:
-		reply = fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+		b = append(b, INTEGER...)
+		b = strconv.AppendInt(b, int64(v.num), 10)
+		b = append(b, "\r\n"...)
 	case BULK:
-		reply = fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+		b = appendBulk(b, v.bulk)
 	case ERROR:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.err)
+		b = append(b, ERROR...)
+		b = appendLine(b, v.err)
+		b = append(b, "\r\n"...)
+	case DOUBLE:
+		if resp2 {
+			b = appendBulk(b, formatDouble(v.dbl))
+			break
+		}
+		b = append(b, DOUBLE...)
+		b = appendDouble(b, v.dbl)
+		b = append(b, "\r\n"...)
+	case BOOLEAN:
+		switch {
+		case resp2 && v.boolean:
+			b = append(b, ":1\r\n"...)
+		case resp2:
+			b = append(b, ":0\r\n"...)
+		case v.boolean:
+			b = append(b, "#t\r\n"...)
+		default:
+			b = append(b, "#f\r\n"...)
+		}
+	case BIGNUMBER:
+		if resp2 {
+			b = appendBulk(b, v.str)
+			break
+		}
+		b = append(b, BIGNUMBER...)
+		b = append(b, v.str...)
+		b = append(b, "\r\n"...)
+	case VERBATIM:
+		if resp2 {
+			b = appendBulk(b, v.bulk)
+			break
+		}
+		// The length covers the format, the colon and the text
+		b = appendHeader(b, VERBATIM, len(v.format)+1+len(v.bulk))
+		b = append(b, v.format...)
+		b = append(b, ':')
+		b = append(b, v.bulk...)
+		b = append(b, "\r\n"...)
 	case NULL:
-		reply = "$-1\r\n" // Send a bulk string with a length of -1
+		if resp2 {
+			b = append(b, "$-1\r\n"...) // Send a bulk string with a length of -1
+		} else {
+			b = append(b, "_\r\n"...)
+		}
+	case NULLARRAY:
+		if resp2 {
+			b = append(b, "*-1\r\n"...) // Send an array with a length of -1
+		} else {
+			b = append(b, "_\r\n"...)
+		}
 	default:
 		log.Println("Invalid typ received")
-		return reply
 	}
 
-	return reply
+	return b
+}
+
+// appendHeader appends the type and length that start aggregates and bulk strings
+func appendHeader(b []byte, typ ValueType, n int) []byte {
+	b = append(b, typ...)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, "\r\n"...)
+}
+
+// appendLine appends the text of a simple string or error. They end at the first \r or \n,
+// so any that come from client data, like a key in an error message, are replaced by spaces
+func appendLine(b []byte, s string) []byte {
+	start := len(b)
+	b = append(b, s...)
+	for i := start; i < len(b); i++ {
+		if b[i] == '\r' || b[i] == '\n' {
+			b[i] = ' '
+		}
+	}
+	return b
+}
+
+// appendBulk appends a bulk string
+func appendBulk(b []byte, s string) []byte {
+	b = appendHeader(b, BULK, len(s))
+	b = append(b, s...)
+	return append(b, "\r\n"...)
+}
+
+// appendDouble appends a double the way RESP3 expects, spelling out infinities and NaN
+func appendDouble(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	case math.IsNaN(f):
+		return append(b, "nan"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// formatDouble formats a double the way RESP3 expects
+func formatDouble(f float64) string {
+	return string(appendDouble(nil, f))
 }
 
-// Write automates the process of creating RESP messages from `Value` objects
+// Write automates the process of creating RESP messages from `Value` objects.
+// Replies are serialized straight into the output buffer, which is reused once sent, so small replies don't allocate.
+// Write never waits for the connection, so writing to a slow client never holds up the one writing
 func (w *Writer) Write(v *Value) {
-	reply := w.Deserialize(v)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = w.appendValue(w.buf, v)
+}
+
+// Queued returns how many bytes of replies haven't been sent yet
+func (w *Writer) Queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// Write to the writer
-	w.writer.Write([]byte(reply))
+	return len(w.buf) + w.sending
 }
 
-// Flush the buffer to force writing
+// Flush sends the buffered replies. Replies written meanwhile go to the spare buffer, and are sent by the next Flush
 func (w *Writer) Flush() {
-	w.writer.(*bufio.Writer).Flush()
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	b := w.buf
+	w.buf, w.spare = w.spare[:0], nil
+	w.sending = len(b)
+	w.mu.Unlock()
+
+	if len(b) > 0 {
+		w.writer.Write(b)
+	}
+
+	w.mu.Lock()
+	w.sending = 0
+	if cap(b) <= maxSpareBuffer {
+		w.spare = b
+	}
+	w.mu.Unlock()
+}
+
+// RequestFlush asks for the buffered replies to be sent in the background, by FlushRequested.
+// Used for replies the client isn't waiting for, like pub/sub messages. It never blocks
+func (w *Writer) RequestFlush() {
+	select {
+	case w.flushRequests <- struct{}{}:
+	default: // A flush is already coming up
+	}
+}
+
+// FlushRequested sends the buffered replies whenever RequestFlush asks for it, until stop is closed
+func (w *Writer) FlushRequested(stop <-chan struct{}) {
+	for {
+		select {
+		case <-w.flushRequests:
+			w.Flush()
+		case <-stop:
+			return
+		}
+	}
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// largeArray is a reply like LRANGE of a long list, or KEYS on a big DB
+func largeArray() *Value {
+	reply := Value{typ: ARRAY, array: make([]Value, 10000)}
+	for i := range reply.array {
+		reply.array[i] = Value{typ: BULK, bulk: "element:" + strconv.Itoa(i)}
+	}
+	return &reply
+}
+
+// pipelinedReplies are the replies to a pipeline of mixed commands, sent with a single flush
+func pipelinedReplies() []*Value {
+	var replies []*Value
+	for i := range 1000 {
+		switch i % 4 {
+		case 0:
+			replies = append(replies, &Value{typ: STRING, str: "OK"})
+		case 1:
+			replies = append(replies, &Value{typ: INTEGER, num: i})
+		case 2:
+			replies = append(replies, &Value{typ: BULK, bulk: "value:" + strconv.Itoa(i)})
+		default:
+			replies = append(replies, &Value{typ: NULL})
+		}
+	}
+	return replies
+}
+
+// sprintfReply serializes a reply the way the writer did before replies were appended to a buffer,
+// by building a string with fmt.Sprintf. It's only kept as the baseline for the benchmarks
+func sprintfReply(v *Value) (reply string) {
+	switch v.typ {
+	case ARRAY:
+		reply += fmt.Sprintf("*%d\r\n", len(v.array))
+		for _, sub := range v.array {
+			reply += sprintfReply(&sub)
+		}
+	case STRING:
+		reply += fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+	case INTEGER:
+		reply += fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+	case BULK:
+		reply += fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+	case NULL:
+		reply += "$-1\r\n"
+	}
+	return reply
+}
+
+// sprintfWriter writes replies the way the writer did before, through a bufio.Writer
+type sprintfWriter struct {
+	w *bufio.Writer
+}
+
+func (w sprintfWriter) Write(v *Value) {
+	w.w.Write([]byte(sprintfReply(v)))
+}
+
+func (w sprintfWriter) Flush() {
+	w.w.Flush()
+}
+
+func BenchmarkWriteLargeArray(b *testing.B) {
+	reply := largeArray()
+	w := NewWriter(io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		w.Write(reply)
+		w.Flush()
+	}
+}
+
+func BenchmarkWritePipelined(b *testing.B) {
+	replies := pipelinedReplies()
+	w := NewWriter(io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		for _, reply := range replies {
+			w.Write(reply)
+		}
+		w.Flush()
+	}
+}
+
+func BenchmarkSprintfLargeArray(b *testing.B) {
+	reply := largeArray()
+	w := sprintfWriter{bufio.NewWriter(io.Discard)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		w.Write(reply)
+		w.Flush()
+	}
+}
+
+func BenchmarkSprintfPipelined(b *testing.B) {
+	replies := pipelinedReplies()
+	w := sprintfWriter{bufio.NewWriter(io.Discard)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		for _, reply := range replies {
+			w.Write(reply)
+		}
+		w.Flush()
+	}
+}
+
+func BenchmarkAppendValueLargeArray(b *testing.B) {
+	reply := largeArray()
+	w := NewWriter(io.Discard)
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		buf = w.appendValue(buf[:0], reply)
+	}
+}